@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+)
+
+// Where the camera is and what it looks at on a certain frame.
+type cameraKey struct {
+	frame            float64
+	lookFrom, lookAt vec3
+	fov, focusDist   float64
+}
+
+func camKey(frame float64, lookFrom, lookAt vec3, fov, focusDist float64) cameraKey {
+	return cameraKey{frame, lookFrom, lookAt, fov, focusDist}
+}
+
+// Keyframes for the camera, sorted by frame. Smooth paths use Catmull-Rom splines,
+// so the camera doesn't change direction abruptly at a key, otherwise it moves in straight lines.
+type cameraPath struct {
+	keys   []cameraKey
+	smooth bool
+}
+
+func camPath(smooth bool, keys ...cameraKey) *cameraPath {
+	p := &cameraPath{make([]cameraKey, len(keys)), smooth}
+	copy(p.keys, keys)
+	sort.Slice(p.keys, func(i, j int) bool { return p.keys[i].frame < p.keys[j].frame })
+
+	return p
+}
+
+// Creates a copy of base that's moved to the place it should be on this frame.
+// Everything that isn't part of the keys, like the lens and shutter, stays the same.
+func (p *cameraPath) at(base *camera, frame float64) *camera {
+	k := p.interpolate(frame)
+
+	c := *base
+	c.lookFrom = k.lookFrom
+	c.lookAt = k.lookAt
+	c.fov = k.fov
+	c.focusDist = k.focusDist
+	c.update()
+
+	return &c
+}
+
+func (p *cameraPath) interpolate(frame float64) cameraKey {
+	n := len(p.keys)
+	if frame <= p.keys[0].frame {
+		return p.keys[0]
+	}
+	if frame >= p.keys[n-1].frame {
+		return p.keys[n-1]
+	}
+
+	// The keys before and after the frame, and the ones around them for the spline.
+	i := sort.Search(n, func(i int) bool { return p.keys[i].frame > frame })
+	k1, k2 := p.keys[i-1], p.keys[i]
+	k0, k3 := k1, k2
+	if i >= 2 {
+		k0 = p.keys[i-2]
+	}
+	if i+1 < n {
+		k3 = p.keys[i+1]
+	}
+	f := (frame - k1.frame) / (k2.frame - k1.frame)
+
+	if !p.smooth {
+		return cameraKey{
+			frame,
+			lerpVec(k1.lookFrom, k2.lookFrom, f),
+			lerpVec(k1.lookAt, k2.lookAt, f),
+			lerp(k1.fov, k2.fov, f),
+			lerp(k1.focusDist, k2.focusDist, f),
+		}
+	}
+
+	return cameraKey{
+		frame,
+		catmullRomVec(k0.lookFrom, k1.lookFrom, k2.lookFrom, k3.lookFrom, f),
+		catmullRomVec(k0.lookAt, k1.lookAt, k2.lookAt, k3.lookAt, f),
+		catmullRom(k0.fov, k1.fov, k2.fov, k3.fov, f),
+		catmullRom(k0.focusDist, k1.focusDist, k2.focusDist, k3.focusDist, f),
+	}
+}
+
+func lerp(a, b, f float64) float64 {
+	return a + (b-a)*f
+}
+
+func lerpVec(a, b vec3, f float64) vec3 {
+	return a.add(b.sub(a).mulScalar(f))
+}
+
+// Goes through p1 at f = 0 and p2 at f = 1, p0 and p3 decide the direction at those points.
+func catmullRom(p0, p1, p2, p3, f float64) float64 {
+	f2 := f * f
+	f3 := f2 * f
+	return 0.5 * (2.0*p1 + (p2-p0)*f + (2.0*p0-5.0*p1+4.0*p2-p3)*f2 + (3.0*p1-p0-3.0*p2+p3)*f3)
+}
+
+func catmullRomVec(p0, p1, p2, p3 vec3, f float64) vec3 {
+	return vec(
+		catmullRom(p0.x, p1.x, p2.x, p3.x, f),
+		catmullRom(p0.y, p1.y, p2.y, p3.y, f),
+		catmullRom(p0.z, p1.z, p2.z, p3.z, f),
+	)
+}
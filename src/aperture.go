@@ -0,0 +1,140 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The shape of the lens opening, it's what out of focus highlights (bokeh) look like.
+type apertureShape interface {
+	// Maps a 2D sample to a point on the aperture, within the unit disk.
+	sample(u, v float64) (float64, float64)
+}
+
+// A perfectly round opening, this is what we get without setting a shape.
+type circleAperture struct{}
+
+func circleAp() apertureShape {
+	return circleAperture{}
+}
+
+func (a circleAperture) sample(u, v float64) (float64, float64) {
+	p := concentricDisk(u, v)
+	return p.x, p.y
+}
+
+// An opening made by a number of straight blades, like most real lenses.
+type polyAperture struct {
+	blades   int
+	rotation float64
+}
+
+// Rotation is in degrees, with zero the first corner points to the right.
+func polyAp(blades int, rotation float64) apertureShape {
+	if blades < 3 {
+		blades = 3
+	}
+	return polyAperture{blades, rotation * math.Pi / 180.0}
+}
+
+func (a polyAperture) sample(u, v float64) (float64, float64) {
+	// The polygon is a fan of triangles around the center, all with the same area.
+	// Pick one with u and use what's left of u to sample inside of it.
+	n := float64(a.blades)
+	k := math.Floor(u * n)
+	u = u*n - k
+
+	sin0, cos0 := math.Sincos(a.rotation + 2.0*math.Pi*k/n)
+	sin1, cos1 := math.Sincos(a.rotation + 2.0*math.Pi*(k+1.0)/n)
+
+	// Uniform in the triangle between the center and the two corners.
+	su := math.Sqrt(u)
+	x := su * (cos0*(1.0-v) + cos1*v)
+	y := su * (sin0*(1.0-v) + sin1*v)
+
+	return x, y
+}
+
+// Any shape, bright pixels of the image let more light through.
+type imageAperture struct {
+	nx, ny   int
+	marginal []float64   // Cumulative brightness of the rows.
+	rows     [][]float64 // Cumulative brightness of the pixels in every row.
+}
+
+func imageAp(name string) apertureShape {
+	name, err := filepath.Abs(name)
+	check(err)
+
+	file, err := os.Open(name)
+	check(err)
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	check(err)
+
+	b := img.Bounds()
+	a := &imageAperture{nx: b.Dx(), ny: b.Dy()}
+	a.marginal = make([]float64, a.ny)
+	a.rows = make([][]float64, a.ny)
+
+	total := 0.0
+	for j := 0; j < a.ny; j++ {
+		row := make([]float64, a.nx)
+		sum := 0.0
+		for i := 0; i < a.nx; i++ {
+			g := color.GrayModel.Convert(img.At(b.Min.X+i, b.Min.Y+j)).(color.Gray)
+			sum += float64(g.Y) / 255.0
+			row[i] = sum
+		}
+		a.rows[j] = row
+		total += sum
+		a.marginal[j] = total
+	}
+
+	if total == 0.0 {
+		panic("aperture image " + name + " is completely black")
+	}
+
+	return a
+}
+
+func (a *imageAperture) sample(u, v float64) (float64, float64) {
+	// Find the row first, then the pixel in that row.
+	j, dv := sampleCDF(a.marginal, v)
+	i, du := sampleCDF(a.rows[j], u)
+
+	// Fit the longest side of the image in -1 to 1, the top of the image is up.
+	size := float64(a.nx)
+	if a.ny > a.nx {
+		size = float64(a.ny)
+	}
+	x := (2.0*(float64(i)+du) - float64(a.nx)) / size
+	y := (float64(a.ny) - 2.0*(float64(j)+dv)) / size
+
+	return x, y
+}
+
+// Picks an index with a probability proportional to its share of the cumulative sums,
+// also returns where in that index we ended up, so we don't get a grid of points.
+func sampleCDF(cdf []float64, u float64) (int, float64) {
+	target := u * cdf[len(cdf)-1]
+	i := sort.Search(len(cdf), func(i int) bool { return cdf[i] > target })
+	if i >= len(cdf) {
+		i = len(cdf) - 1
+	}
+
+	lo := 0.0
+	if i > 0 {
+		lo = cdf[i-1]
+	}
+	if cdf[i] == lo {
+		return i, 0.5
+	}
+
+	return i, (target - lo) / (cdf[i] - lo)
+}
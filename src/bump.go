@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+)
+
+// Sets a tangent space normal map, the colors are the normal with red along u, green along v and blue out of the surface.
+// Returns the material so calls can be chained.
+func (m *material) normalMapped(tex texture) *material {
+	m.normalMap = tex
+	return m
+}
+
+// Sets a bump map, bright parts of the texture are higher. Scale is how far white sticks out, in scene units.
+func (m *material) bumpMapped(tex texture, scale float64) *material {
+	m.bumpMap = tex
+	m.bumpScale = scale
+	return m
+}
+
+// Changes the normal of the hit with the normal and bump maps of the material.
+// The normal stays on the same side of the surface as it was, the materials depend on that.
+func (m *material) perturb(hr *hitRecord) {
+	if m.normalMap == nil && m.bumpMap == nil {
+		return
+	}
+
+	geom := hr.normal
+	if m.bumpMap != nil {
+		hr.normal = m.bump(hr)
+	}
+	if m.normalMap != nil {
+		hr.normal = m.mapNormal(hr)
+	}
+
+	if dot(hr.normal, geom) < 0.0 {
+		hr.normal = hr.normal.mulScalar(-1.0)
+	}
+}
+
+// The tangent frame of the hit, t goes along u and b along v, both perpendicular to the normal.
+func (hr *hitRecord) tangentFrame() (vec3, vec3) {
+	n := hr.normal
+	t := hr.dpdu.sub(n.mulScalar(dot(n, hr.dpdu)))
+	if t.lengthSqr() < 1e-16 {
+		// No UV derivatives, any direction along the surface is good enough.
+		a := vec(1.0, 0.0, 0.0)
+		if math.Abs(n.x) > 0.9 {
+			a = vec(0.0, 1.0, 0.0)
+		}
+		t = cross(a, n)
+	}
+	t = t.normalize()
+
+	b := cross(n, t)
+	if dot(b, hr.dpdv) < 0.0 {
+		b = b.mulScalar(-1.0)
+	}
+	return t, b
+}
+
+func (m *material) mapNormal(hr *hitRecord) vec3 {
+	c := texValue(m.normalMap, hr)
+	t, b := hr.tangentFrame()
+
+	// From 0 to 1 colors to -1 to 1 directions.
+	x := 2.0*c.x - 1.0
+	y := 2.0*c.y - 1.0
+	z := 2.0*c.z - 1.0
+
+	n := t.mulScalar(x).add(b.mulScalar(y)).add(hr.normal.mulScalar(z))
+	if n.lengthSqr() < 1e-16 {
+		return hr.normal
+	}
+	return n.normalize()
+}
+
+// Moves the surface along the normal by the height of the bump map and works out the normal
+// of that surface, by looking up the height a little further along u and v.
+func (m *material) bump(hr *hitRecord) vec3 {
+	// Small steps, but not smaller than the pixel, otherwise the bumps alias.
+	du := 0.5 * (math.Abs(hr.dudx) + math.Abs(hr.dudy))
+	if du == 0.0 {
+		du = 0.0005
+	}
+	dv := 0.5 * (math.Abs(hr.dvdx) + math.Abs(hr.dvdy))
+	if dv == 0.0 {
+		dv = 0.0005
+	}
+
+	height := m.height(hr, 0.0, 0.0)
+	heightU := m.height(hr, du, 0.0)
+	heightV := m.height(hr, 0.0, dv)
+
+	// The derivatives of the moved surface, the last part is because the normal turns on curved surfaces.
+	dpdu := hr.dpdu.add(hr.normal.mulScalar((heightU - height) / du)).add(hr.dndu.mulScalar(height))
+	dpdv := hr.dpdv.add(hr.normal.mulScalar((heightV - height) / dv)).add(hr.dndv.mulScalar(height))
+
+	n := cross(dpdu, dpdv)
+	if n.lengthSqr() < 1e-16 {
+		return hr.normal
+	}
+	n = n.normalize()
+	if dot(n, hr.normal) < 0.0 {
+		n = n.mulScalar(-1.0)
+	}
+	return n
+}
+
+// The height of the bump map, moved du and dv along the surface.
+func (m *material) height(hr *hitRecord, du, dv float64) float64 {
+	shifted := *hr
+	shifted.u += du
+	shifted.v += dv
+	shifted.p = hr.p.add(hr.dpdu.mulScalar(du)).add(hr.dpdv.mulScalar(dv))
+
+	c := texValue(m.bumpMap, &shifted)
+	return m.bumpScale * gray(c)
+}
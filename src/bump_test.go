@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func vecNear(a, b vec3) bool {
+	return a.sub(b).length() < 1e-6
+}
+
+// A hit on the flat plane z = 0 seen from above, u runs along x and v along y.
+func flatHit(u, v float64) hitRecord {
+	return hitRecord{
+		u: u, v: v, p: vec(u, v, 0.0),
+		normal: vec(0.0, 0.0, 1.0),
+		dpdu:   vec(1.0, 0.0, 0.0),
+		dpdv:   vec(0.0, 1.0, 0.0),
+	}
+}
+
+// The height is u, so the surface goes up along x.
+type slopeTex struct{}
+
+func (slopeTex) value(u, v float64, p vec3) vec3 {
+	return vec(u, u, u)
+}
+
+func TestNormalMap(t *testing.T) {
+	hr := flatHit(0.3, 0.6)
+	dif(col(1.0, 1.0, 1.0)).normalMapped(col(0.5, 0.5, 1.0)).perturb(&hr)
+	if !vecNear(hr.normal, vec(0.0, 0.0, 1.0)) {
+		t.Errorf("a flat normal map changed the normal to %v", hr.normal)
+	}
+
+	// Pointing along u, halfway between the tangent and the normal.
+	hr = flatHit(0.3, 0.6)
+	dif(col(1.0, 1.0, 1.0)).normalMapped(col(1.0, 0.5, 1.0)).perturb(&hr)
+	if want := vec(1.0, 0.0, 1.0).normalize(); !vecNear(hr.normal, want) {
+		t.Errorf("normal is %v, want %v", hr.normal, want)
+	}
+}
+
+func TestBumpMap(t *testing.T) {
+	hr := flatHit(0.3, 0.6)
+	dif(col(1.0, 1.0, 1.0)).bumpMapped(col(0.7, 0.7, 0.7), 1.0).perturb(&hr)
+	if !vecNear(hr.normal, vec(0.0, 0.0, 1.0)) {
+		t.Errorf("a flat bump map changed the normal to %v", hr.normal)
+	}
+
+	// The surface rises 1 for every 1 along x, so the normal leans back along -x by 45 degrees.
+	hr = flatHit(0.3, 0.6)
+	dif(col(1.0, 1.0, 1.0)).bumpMapped(slopeTex{}, 1.0).perturb(&hr)
+	if want := vec(-1.0, 0.0, 1.0).normalize(); !vecNear(hr.normal, want) {
+		t.Errorf("normal is %v, want %v", hr.normal, want)
+	}
+
+	// Seen from below the normal has to stay below.
+	hr = flatHit(0.3, 0.6)
+	hr.normal = vec(0.0, 0.0, -1.0)
+	dif(col(1.0, 1.0, 1.0)).bumpMapped(slopeTex{}, 1.0).perturb(&hr)
+	if hr.normal.z >= 0.0 || math.Abs(hr.normal.length()-1.0) > 1e-9 {
+		t.Errorf("normal flipped to the other side: %v", hr.normal)
+	}
+}
@@ -1,64 +1,512 @@
 package main
 
 import (
+	"fmt"
 	"math"
-	"math/rand"
 )
 
+// Use these to differentiate the different projections of cameras.
+const (
+	projPerspective uint8 = 0
+	projOrtho       uint8 = 1
+	projEquirect    uint8 = 2
+	projFisheye     uint8 = 3
+)
+
+// The ways a fisheye lens can map angles to the image.
+const (
+	fishEquidistant uint8 = 0 // The distance from the center grows linearly with the angle.
+	fishEquisolid   uint8 = 1 // Every pixel covers the same solid angle.
+)
+
+// Height of a full frame (35mm) sensor in millimeters, used to turn focal lengths into a field of view.
+const sensorHeight = 24.0
+
 type camera struct {
+	projection                   uint8
 	lowerLeft, hor, vert, origin vec3
 	u, v, w                      vec3
-	lensRadius, shutter          float64
+	lensRadius                   float64
+
+	// The shutter is open from shutterOpen to shutterClose, the curve says how much light gets
+	// through in between. With a rolling shutter the bottom row opens rollingTime after the top row.
+	shutterOpen, shutterClose float64
+	curve                     *shutterCurve
+	rollingTime               float64
+
+	// The settings, the vectors above are calculated from these in update.
+	lookFrom, lookAt, vup vec3
+	fov, focusDist, roll  float64
+	viewWidth             float64 // Only for orthographic cameras, the fov doesn't mean anything there.
+	fisheyeModel          uint8
+
+	// For stereo, the eye sits this far to the right (or left when negative) of lookFrom,
+	// the images of both eyes line up at the convergence distance.
+	eyeOffset, convergence float64
+
+	// Every camera has its own resolution, so cameras with different formats can share a scene.
+	width, height int
+
+	// The shape of the lens opening, round unless it's changed.
+	bokeh apertureShape
 }
 
-func cam(lookFrom, lookAt vec3, fov, aperture, shutter float64) *camera {
-	c := &camera{}
+func cam(lookFrom, lookAt vec3, fov, aperture, focusDist, shutter float64) *camera {
+	c := baseCam(lookFrom, lookAt, shutter)
 	c.lensRadius = aperture / 2.0
-	c.shutter = shutter
-	theta := fov * math.Pi / 180.0
-	halfHeight := math.Tan(theta / 2.0)
-	halfWidth := (float64(width) / float64(height)) * halfHeight
-	focusDist := 10.0
+	c.fov = fov
+	c.focusDist = focusDist
+	c.update()
+
+	return c
+}
+
+// What every camera has, the projection still has to be set up.
+func baseCam(lookFrom, lookAt vec3, shutter float64) *camera {
+	c := &camera{}
+	c.shutterClose = shutter
+	c.lookFrom = lookFrom
+	c.lookAt = lookAt
+	c.vup = vec(0.0, 1.0, 0.0)
+	c.width = width
+	c.height = height
+	c.bokeh = circleAp()
+
+	return c
+}
+
+// Orthographic cameras have parallel rays, so parallel lines stay parallel.
+// The view width is the width of the image in scene units.
+func orthoCam(lookFrom, lookAt vec3, viewWidth, shutter float64) *camera {
+	c := cam(lookFrom, lookAt, 0.0, 0.0, lookFrom.sub(lookAt).length(), shutter)
+	c.setOrtho(viewWidth)
+
+	return c
+}
+
+// Turns the camera into an orthographic one, it stays where it is and keeps looking the same way.
+// A view width of zero shows as much as the camera saw at the point it looks at. There's no lens anymore.
+func (c *camera) setOrtho(viewWidth float64) {
+	if viewWidth <= 0.0 {
+		viewWidth = 2.0 * math.Tan(c.fov*math.Pi/360.0) * c.lookFrom.sub(c.lookAt).length() * c.aspect()
+	}
+	if c.focusDist <= 0.0 {
+		c.focusDist = c.lookFrom.sub(c.lookAt).length()
+	}
+
+	c.projection = projOrtho
+	c.viewWidth = viewWidth
+	c.lensRadius = 0.0
+	c.update()
+}
+
+// Equirectangular cameras see everything around them, 360 degrees horizontally and 180 vertically,
+// the center of the image is where the camera looks at. Use an image that is twice as wide as it is high.
+func equirectCam(lookFrom, lookAt vec3, shutter float64) *camera {
+	c := baseCam(lookFrom, lookAt, shutter)
+	c.setEquirect()
+
+	return c
+}
+
+// Fisheye cameras project a circle of fov degrees (up to 360) on the image, it touches the top and bottom.
+func fisheyeCam(lookFrom, lookAt vec3, fov float64, model uint8, shutter float64) *camera {
+	c := baseCam(lookFrom, lookAt, shutter)
+	c.setFisheye(fov, model)
+
+	return c
+}
+
+// Turns the camera into an equirectangular one, it stays where it is and keeps looking the same way.
+func (c *camera) setEquirect() {
+	c.projection = projEquirect
+	c.lensRadius = 0.0
+	c.update()
+}
+
+// Turns the camera into a fisheye, a fov of zero is a half sphere.
+func (c *camera) setFisheye(fov float64, model uint8) {
+	if fov <= 0.0 {
+		fov = 180.0
+	}
+
+	c.projection = projFisheye
+	c.fov = fov
+	c.fisheyeModel = model
+	c.lensRadius = 0.0
+	c.update()
+}
+
+// The fisheye model for a name from the command line.
+func fisheyeModelNamed(name string) (uint8, error) {
+	switch name {
+	case "equidistant":
+		return fishEquidistant, nil
+	case "equisolid":
+		return fishEquisolid, nil
+	}
+
+	return 0, fmt.Errorf("unknown fisheye model %q, use: equidistant or equisolid", name)
+}
+
+// Recalculates the image plane, this needs to happen every time a setting changes.
+func (c *camera) update() {
+	focusDist := c.focusDist
+
+	// Panoramic cameras don't have an image plane, they only need the directions below.
+	var halfWidth, halfHeight float64
+	switch c.projection {
+	case projPerspective:
+		theta := c.fov * math.Pi / 180.0
+		halfHeight = math.Tan(theta / 2.0)
+		halfWidth = c.aspect() * halfHeight
+
+	case projOrtho:
+		// The image plane of an orthographic camera doesn't grow with the distance,
+		// so scale it back to the view width.
+		halfWidth = c.viewWidth / 2.0 / focusDist
+		halfHeight = halfWidth / c.aspect()
+	}
 
 	// This is used to calculate the direction of the camera.
-	c.w = lookFrom.sub(lookAt).normalize() // The difference from the target and position, will give the direction.
-	c.u = cross(vec(0.0, 1.0, 0.0), c.w).normalize()
+	c.w = c.lookFrom.sub(c.lookAt).normalize() // The difference from the target and position, will give the direction.
+
+	// When we look straight along the up vector there is no way to tell what's up,
+	// so pick the axis that is the furthest away from the view direction.
+	up := c.vup
+	if cross(up, c.w).lengthSqr() < 1e-12 {
+		switch {
+		case math.Abs(c.w.x) <= math.Abs(c.w.y) && math.Abs(c.w.x) <= math.Abs(c.w.z):
+			up = vec(1.0, 0.0, 0.0)
+		case math.Abs(c.w.y) <= math.Abs(c.w.z):
+			up = vec(0.0, 1.0, 0.0)
+		default:
+			up = vec(0.0, 0.0, 1.0)
+		}
+	}
+	c.u = cross(up, c.w).normalize()
 	c.v = cross(c.w, c.u)
 
-	c.origin = lookFrom
+	// Roll the camera around the view direction.
+	if c.roll != 0.0 {
+		sin, cos := math.Sincos(c.roll * math.Pi / 180.0)
+		c.u, c.v = c.u.mulScalar(cos).add(c.v.mulScalar(sin)), c.v.mulScalar(cos).sub(c.u.mulScalar(sin))
+	}
+
+	c.origin = c.lookFrom
 	c.lowerLeft = c.origin.sub(c.u.mulScalar(halfWidth * focusDist)).sub(c.v.mulScalar(halfHeight * focusDist)).sub(c.w.mulScalar(focusDist))
 	c.hor = c.u.mulScalar(2.0 * halfWidth * focusDist)
 	c.vert = c.v.mulScalar(2.0 * halfHeight * focusDist)
 
-	return c
+	// Move the eye sideways, but keep looking in the same direction (no toe-in). Instead the image
+	// plane is shifted, so the images of both eyes are exactly the same at the convergence distance.
+	if c.eyeOffset != 0.0 {
+		shift := 1.0
+		if c.convergence > 0.0 {
+			shift -= focusDist / c.convergence
+		}
+		c.origin = c.origin.add(c.u.mulScalar(c.eyeOffset))
+		c.lowerLeft = c.lowerLeft.add(c.u.mulScalar(c.eyeOffset * shift))
+	}
+}
+
+// Creates the cameras for the left and right eye, iod is the distance between the eyes.
+// When the convergence is zero the eyes converge at the focus distance, for panoramic cameras they look parallel.
+// Equirectangular cameras give omni-directional stereo, the eyes turn around with the view.
+func (c *camera) stereoPair(iod, convergence float64) (*camera, *camera) {
+	if convergence <= 0.0 && c.projection != projEquirect && c.projection != projFisheye {
+		convergence = c.focusDist
+	}
+
+	left, right := *c, *c
+	left.eyeOffset = -iod / 2.0
+	right.eyeOffset = iod / 2.0
+	left.convergence = convergence
+	right.convergence = convergence
+	left.update()
+	right.update()
+
+	return &left, &right
+}
+
+func (c *camera) aspect() float64 {
+	return float64(c.width) / float64(c.height)
 }
 
-func (c *camera) ray(s, t float64, rnd *rand.Rand) ray {
+// The up vector doesn't have to be perpendicular to the view direction, it only decides which way is up.
+func (c *camera) setUp(vup vec3) {
+	c.vup = vup
+	c.update()
+}
+
+// Rolls the camera counter-clockwise (as seen from behind the camera) in degrees.
+func (c *camera) setRoll(deg float64) {
+	c.roll = deg
+	c.update()
+}
+
+// Changing the resolution also changes the aspect ratio, the vertical field of view stays the same.
+func (c *camera) setResolution(w, h int) {
+	c.width = w
+	c.height = h
+	c.update()
+}
+
+// The shutter lets light through from open until close.
+func (c *camera) setShutter(open, close float64) {
+	c.shutterOpen = open
+	c.shutterClose = close
+}
+
+// Use nil for a shutter that opens and closes instantly.
+func (c *camera) setShutterCurve(curve *shutterCurve) {
+	c.curve = curve
+}
+
+// A rolling shutter reads the rows one after the other, from the top to the bottom of the image.
+// The readout is the time between the top and bottom row, every row stays open equally long.
+func (c *camera) setRollingShutter(readout float64) {
+	c.rollingTime = readout
+}
+
+// The first and last moment a ray can be sent.
+func (c *camera) timeRange() (float64, float64) {
+	return c.shutterOpen, c.shutterClose + c.rollingTime
+}
+
+// The moment a ray is sent, u is a random number and t the vertical position on the image.
+func (c *camera) time(u, t float64) float64 {
+	if c.curve != nil {
+		u = c.curve.sample(u)
+	}
+
+	// t is 1 at the top of the image, that row is read first.
+	return c.shutterOpen + u*(c.shutterClose-c.shutterOpen) + (1.0-t)*c.rollingTime
+}
+
+// Changes the shape of the lens opening, for polygonal or custom bokeh.
+func (c *camera) setAperture(shape apertureShape) {
+	c.bokeh = shape
+}
+
+// Everything at this distance from the camera is sharp, it's measured along the view direction.
+func (c *camera) setFocus(dist float64) {
+	c.focusDist = dist
+	c.update()
+}
+
+// Traces a ray through a pixel of the saved image (0, 0 is the top left) and focuses on whatever it hits.
+// Returns false when the ray doesn't hit anything, the focus distance stays the same then.
+func (c *camera) autofocus(scn *scene, px, py int) bool {
+	s := (float64(px) + 0.5) / float64(c.width)
+	t := 1.0 - (float64(py)+0.5)/float64(c.height)
+
+	if !c.covers(s, t) {
+		return false
+	}
+
+	// No lens and no motion, we just want to know what's in the middle of the pixel.
+	var r ray
+	switch c.projection {
+	case projEquirect, projFisheye:
+		origin, dir := c.panoRay(s, t)
+		r = ray{origin: origin, dir: dir}
+	default:
+		target := c.target(s, t)
+		origin := c.start(target)
+		r = ray{origin: origin, dir: target.sub(origin)}
+	}
+
+	hr := hitRecord{}
+	if !scn.hit(r, 0.001, math.MaxFloat64, &hr) {
+		return false
+	}
+
+	c.setFocus(dot(hr.p.sub(r.origin), c.w.mulScalar(-1.0)))
+	return true
+}
+
+// The vertical field of view in degrees, for fisheyes it's the whole circle.
+func (c *camera) setFov(deg float64) {
+	c.fov = deg
+	c.update()
+}
+
+// Sets the field of view like a lens of this many millimeters would on a full frame camera.
+// Focal lengths and f-stops only mean something for perspective cameras.
+func (c *camera) setFocalLength(mm float64) {
+	c.fov = 2.0 * math.Atan(sensorHeight/(2.0*mm)) * 180.0 / math.Pi
+	c.update()
+}
+
+func (c *camera) focalLength() float64 {
+	return sensorHeight / (2.0 * math.Tan(c.fov*math.Pi/360.0))
+}
+
+// Sets the aperture with an f-number, like f/2.8. The opening is the focal length divided
+// by the f-number, the scene is taken to be in meters.
+func (c *camera) setFStop(n float64) {
+	c.lensRadius = c.focalLength() / n / 2.0 / 1000.0
+}
+
+func (c *camera) ray(s, t float64, rnd sampler) ray {
+	ds, dt := c.pixelStep()
+
+	switch c.projection {
+	case projEquirect, projFisheye:
+		// Panoramic cameras don't have a lens.
+		origin, dir := c.panoRay(s, t)
+		r := ray{origin: origin, dir: dir, time: c.time(rnd.get1D(), t)}
+		r.diff.rxOrigin, r.diff.rxDir = c.panoRay(s+ds, t)
+		r.diff.ryOrigin, r.diff.ryDir = c.panoRay(s, t+dt)
+		r.diff.has = true
+		return r
+	}
+
 	// Better performance, because there are no random numbers needed.
 	// Even if we would calculate them, we would multiply by zero, so this is useless.
-	if c.lensRadius == 0.0 {
-		return ray{
-			c.origin,
-			c.lowerLeft.add(c.hor.mulScalar(s).add(c.vert.mulScalar(t))).sub(c.origin),
-			rnd.Float64() * c.shutter,
-		}
+	offset := vec3{}
+	if c.lensRadius != 0.0 {
+		// Add blur, when there is a higher radius.
+		rd := c.lensSample(rnd).mulScalar(c.lensRadius)
+		offset = c.u.mulScalar(rd.x).add(c.v.mulScalar(rd.y))
 	}
 
-	// Add blur, when there is a higher radius.
-	rd := randInDisk(rnd).mulScalar(c.lensRadius)
-	offset := c.u.mulScalar(rd.x).add(c.v.mulScalar(rd.y))
+	origin, dir := c.lensRay(s, t, offset)
+	r := ray{origin: origin, dir: dir, time: c.time(rnd.get1D(), t)}
+
+	// The neighbouring rays go through the same point on the lens, otherwise the lens blur would count as texture blur.
+	r.diff.rxOrigin, r.diff.rxDir = c.lensRay(s+ds, t, offset)
+	r.diff.ryOrigin, r.diff.ryDir = c.lensRay(s, t+dt, offset)
+	r.diff.has = true
+
+	return r
+}
 
-	return ray{
-		c.origin.add(offset),
-		c.lowerLeft.add(c.hor.mulScalar(s).add(c.vert.mulScalar(t))).sub(c.origin).sub(offset),
-		rnd.Float64() * c.shutter,
+// The ray through s, t that passes the lens at offset from its center.
+func (c *camera) lensRay(s, t float64, offset vec3) (vec3, vec3) {
+	target := c.target(s, t)
+	origin := c.start(target)
+
+	return origin.add(offset), target.sub(origin).sub(offset)
+}
+
+// How far the differentials are from the ray in s and t. That's a pixel, but with more samples
+// every sample only has to cover part of the pixel, so the textures don't get blurrier than needed.
+func (c *camera) pixelStep() (float64, float64) {
+	scale := math.Max(0.125, 1.0/math.Sqrt(float64(samples)))
+	return scale / float64(c.width), scale / float64(c.height)
+}
+
+// The point on the focus plane that s, t looks at.
+func (c *camera) target(s, t float64) vec3 {
+	return c.lowerLeft.add(c.hor.mulScalar(s).add(c.vert.mulScalar(t)))
+}
+
+// Where the ray towards target starts, before the lens moves it.
+func (c *camera) start(target vec3) vec3 {
+	switch c.projection {
+	case projOrtho:
+		// Every ray starts on the plane of the camera, straight behind its target.
+		return target.add(c.w.mulScalar(c.focusDist))
+	default:
+		return c.origin
+	}
+}
+
+// Not every camera fills the whole image, the corners of a fisheye image stay black.
+func (c *camera) covers(s, t float64) bool {
+	if c.projection != projFisheye {
+		return true
+	}
+
+	x, y := c.fisheyeXY(s, t)
+	return x*x+y*y <= 1.0
+}
+
+// The position on the image with the fisheye circle being the unit circle.
+func (c *camera) fisheyeXY(s, t float64) (float64, float64) {
+	return (2.0*s - 1.0) * c.aspect(), 2.0*t - 1.0
+}
+
+// Every ray of a panoramic camera starts in the same point, except for omni-directional stereo.
+// There the eye moves around on a circle, so it's always to the side of the direction we look at.
+func (c *camera) panoRay(s, t float64) (vec3, vec3) {
+	dir := c.panoDir(s, t)
+	if c.projection != projEquirect || c.eyeOffset == 0.0 {
+		return c.origin, dir
+	}
+
+	sinLon, cosLon := math.Sincos((s - 0.5) * 2.0 * math.Pi)
+	side := c.u.mulScalar(cosLon).add(c.w.mulScalar(sinLon))
+	origin := c.lookFrom.add(side.mulScalar(c.eyeOffset))
+
+	// Turn in a little, so both eyes look at the same point at the convergence distance.
+	if c.convergence > 0.0 {
+		dir = c.lookFrom.add(dir.mulScalar(c.convergence)).sub(origin)
+	}
+
+	return origin, dir
+}
+
+// The direction s, t looks at for the panoramic cameras.
+func (c *camera) panoDir(s, t float64) vec3 {
+	forward := c.w.mulScalar(-1.0)
+
+	switch c.projection {
+	case projEquirect:
+		// s goes around the camera, t goes from straight down to straight up.
+		sinLon, cosLon := math.Sincos((s - 0.5) * 2.0 * math.Pi)
+		sinLat, cosLat := math.Sincos((t - 0.5) * math.Pi)
+
+		return forward.mulScalar(cosLat * cosLon).add(c.u.mulScalar(cosLat * sinLon)).add(c.v.mulScalar(sinLat))
+
+	case projFisheye:
+		x, y := c.fisheyeXY(s, t)
+		r := math.Sqrt(x*x + y*y)
+
+		// The angle between the ray and the view direction.
+		maxTheta := c.fov * math.Pi / 360.0
+		var theta float64
+		if c.fisheyeModel == fishEquisolid {
+			theta = 2.0 * math.Asin(math.Min(1.0, r*math.Sin(maxTheta/2.0)))
+		} else {
+			theta = r * maxTheta
+		}
+
+		sinTheta, cosTheta := math.Sincos(theta)
+		phi := math.Atan2(y, x)
+		side := c.u.mulScalar(math.Cos(phi)).add(c.v.mulScalar(math.Sin(phi)))
+
+		return forward.mulScalar(cosTheta).add(side.mulScalar(sinTheta))
 	}
+
+	return forward
 }
 
-func randInDisk(rnd *rand.Rand) vec3 {
-	p := vec(rnd.Float64(), rnd.Float64(), 0.0).mulScalar(2.0).sub(vec(1.0, 1.0, 0.0))
-	for dot(p, p) >= 1.0 {
-		p = vec(rnd.Float64(), rnd.Float64(), 0.0).mulScalar(2.0).sub(vec(1.0, 1.0, 0.0))
+// A random point on the lens opening.
+func (c *camera) lensSample(rnd sampler) vec3 {
+	u, v := rnd.get2D()
+	x, y := c.bokeh.sample(u, v)
+	return vec(x, y, 0.0)
+}
+
+// Maps a 2D sample to the unit disk, using the concentric mapping of Shirley and Chiu.
+func concentricDisk(u, v float64) vec3 {
+	u = 2.0*u - 1.0
+	v = 2.0*v - 1.0
+	if u == 0.0 && v == 0.0 {
+		return vec(0.0, 0.0, 0.0)
+	}
+
+	var r, theta float64
+	if math.Abs(u) > math.Abs(v) {
+		r = u
+		theta = math.Pi / 4.0 * (v / u)
+	} else {
+		r = v
+		theta = math.Pi/2.0 - math.Pi/4.0*(u/v)
 	}
-	return p
+
+	return vec(r*math.Cos(theta), r*math.Sin(theta), 0.0)
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+)
+
+// Two extra rays next to a ray, one a pixel to the right and one a pixel up. They're never traced,
+// we only look at where they would hit the tangent plane of whatever the ray hits.
+type rayDiff struct {
+	has             bool
+	rxOrigin, rxDir vec3
+	ryOrigin, ryDir vec3
+}
+
+// Finds out how big the footprint of the ray is on the surface, in the scene and in UV space.
+func (hr *hitRecord) differentials(r ray) {
+	hr.dpdx, hr.dpdy = vec3{}, vec3{}
+	hr.dudx, hr.dvdx, hr.dudy, hr.dvdy = 0.0, 0.0, 0.0, 0.0
+	if !r.diff.has {
+		return
+	}
+
+	// Where the neighbouring rays hit the plane that touches the surface in p.
+	d := dot(hr.normal, hr.p)
+	tx := (d - dot(hr.normal, r.diff.rxOrigin)) / dot(hr.normal, r.diff.rxDir)
+	ty := (d - dot(hr.normal, r.diff.ryOrigin)) / dot(hr.normal, r.diff.ryDir)
+	if math.IsNaN(tx) || math.IsNaN(ty) || math.IsInf(tx, 0) || math.IsInf(ty, 0) {
+		return
+	}
+	hr.dpdx = r.diff.rxOrigin.add(r.diff.rxDir.mulScalar(tx)).sub(hr.p)
+	hr.dpdy = r.diff.ryOrigin.add(r.diff.ryDir.mulScalar(ty)).sub(hr.p)
+
+	// Now solve dpdx = dpdu * dudx + dpdv * dvdx for the UVs. That's three equations for two unknowns,
+	// so leave out the axis the normal points along the most, it's the one that says the least.
+	a, b := 0, 1
+	n := hr.normal
+	if math.Abs(n.x) > math.Abs(n.y) && math.Abs(n.x) > math.Abs(n.z) {
+		a, b = 1, 2
+	} else if math.Abs(n.y) > math.Abs(n.z) {
+		a, b = 0, 2
+	}
+
+	hr.dudx, hr.dvdx = solve2x2(hr.dpdu.get(a), hr.dpdv.get(a), hr.dpdu.get(b), hr.dpdv.get(b), hr.dpdx.get(a), hr.dpdx.get(b))
+	hr.dudy, hr.dvdy = solve2x2(hr.dpdu.get(a), hr.dpdv.get(a), hr.dpdu.get(b), hr.dpdv.get(b), hr.dpdy.get(a), hr.dpdy.get(b))
+}
+
+// Solves the system with rows (a, b) and (c, d) for e and f, gives zeros when there's no solution.
+func solve2x2(a, b, c, d, e, f float64) (float64, float64) {
+	det := a*d - b*c
+	if math.Abs(det) < 1e-12 {
+		return 0.0, 0.0
+	}
+
+	x := (d*e - b*f) / det
+	y := (a*f - c*e) / det
+	if math.IsNaN(x) || math.IsNaN(y) || math.IsInf(x, 0) || math.IsInf(y, 0) {
+		return 0.0, 0.0
+	}
+	return x, y
+}
+
+// How the normal changes to the next pixel, curved mirrors spread the neighbouring rays further apart.
+func (hr *hitRecord) normalDiffs() (vec3, vec3) {
+	dndx := hr.dndu.mulScalar(hr.dudx).add(hr.dndv.mulScalar(hr.dvdx))
+	dndy := hr.dndu.mulScalar(hr.dudy).add(hr.dndv.mulScalar(hr.dvdy))
+	return dndx, dndy
+}
+
+// The differentials of a perfect mirror reflection of rIn into dir.
+func reflectDiff(rIn ray, hr *hitRecord, dir vec3) rayDiff {
+	if !rIn.diff.has {
+		return rayDiff{}
+	}
+
+	n := hr.normal
+	wo := rIn.dir.normalize().mulScalar(-1.0)
+	wi := dir.normalize()
+	dndx, dndy := hr.normalDiffs()
+
+	// How the outgoing direction changes, from the directions of the neighbouring rays.
+	dwodx := rIn.diff.rxDir.normalize().mulScalar(-1.0).sub(wo)
+	dwody := rIn.diff.ryDir.normalize().mulScalar(-1.0).sub(wo)
+	dDNdx := dot(dwodx, n) + dot(wo, dndx)
+	dDNdy := dot(dwody, n) + dot(wo, dndy)
+
+	return rayDiff{
+		has:      true,
+		rxOrigin: hr.p.add(hr.dpdx),
+		ryOrigin: hr.p.add(hr.dpdy),
+		rxDir:    wi.sub(dwodx).add(dndx.mulScalar(dot(wo, n)).add(n.mulScalar(dDNdx)).mulScalar(2.0)),
+		ryDir:    wi.sub(dwody).add(dndy.mulScalar(dot(wo, n)).add(n.mulScalar(dDNdy)).mulScalar(2.0)),
+	}
+}
+
+// The differentials of rIn refracting into dir, outwardNormal and niOverNt are the ones the refraction used.
+func refractDiff(rIn ray, hr *hitRecord, dir, outwardNormal vec3, niOverNt float64) rayDiff {
+	if !rIn.diff.has {
+		return rayDiff{}
+	}
+
+	n := outwardNormal
+	wo := rIn.dir.normalize().mulScalar(-1.0)
+	wi := dir.normalize()
+	dndx, dndy := hr.normalDiffs()
+	if dot(n, hr.normal) < 0.0 {
+		// We're inside, the normal got flipped so its derivatives do too.
+		dndx = dndx.mulScalar(-1.0)
+		dndy = dndy.mulScalar(-1.0)
+	}
+
+	dwodx := rIn.diff.rxDir.normalize().mulScalar(-1.0).sub(wo)
+	dwody := rIn.diff.ryDir.normalize().mulScalar(-1.0).sub(wo)
+	dDNdx := dot(dwodx, n) + dot(wo, dndx)
+	dDNdy := dot(dwody, n) + dot(wo, dndy)
+
+	eta := niOverNt
+	cosI := dot(wo, n)
+	cosT := math.Abs(dot(wi, n))
+	mu := eta*cosI - cosT
+	dmu := eta - eta*eta*cosI/cosT
+
+	return rayDiff{
+		has:      true,
+		rxOrigin: hr.p.add(hr.dpdx),
+		ryOrigin: hr.p.add(hr.dpdy),
+		rxDir:    wi.sub(dwodx.mulScalar(eta)).add(dndx.mulScalar(mu).add(n.mulScalar(dmu * dDNdx))),
+		ryDir:    wi.sub(dwody.mulScalar(eta)).add(dndy.mulScalar(mu).add(n.mulScalar(dmu * dDNdy))),
+	}
+}
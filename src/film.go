@@ -0,0 +1,106 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// The film collects the weighted samples for a range of rows. Every goroutine splats into
+// its own small film, those are added to the big one in order, so the result never depends
+// on which goroutine finished first.
+type film struct {
+	width, y0, height int
+	col               []vec3
+	weight            []float64
+}
+
+func newFilm(width, y0, height int) *film {
+	return &film{
+		width, y0, height,
+		make([]vec3, width*height),
+		make([]float64, width*height),
+	}
+}
+
+// Adds a sample at film position x, y to all the pixels that are within the radius of the filter.
+func (f *film) splat(x, y float64, col vec3, flt filter) {
+	r := flt.radius()
+
+	// Pixel centers are at half pixel coordinates.
+	x0 := int(math.Ceil(x - 0.5 - r))
+	x1 := int(math.Floor(x - 0.5 + r))
+	y0 := int(math.Ceil(y - 0.5 - r))
+	y1 := int(math.Floor(y - 0.5 + r))
+
+	for py := y0; py <= y1; py++ {
+		if py < f.y0 || py >= f.y0+f.height {
+			continue
+		}
+		wy := flt.eval(y - (float64(py) + 0.5))
+		if wy == 0.0 {
+			continue
+		}
+
+		for px := x0; px <= x1; px++ {
+			if px < 0 || px >= f.width {
+				continue
+			}
+			w := wy * flt.eval(x-(float64(px)+0.5))
+			if w == 0.0 {
+				continue
+			}
+
+			i := (py-f.y0)*f.width + px
+			f.col[i] = f.col[i].add(col.mulScalar(w))
+			f.weight[i] += w
+		}
+	}
+}
+
+// Adds the samples of another film to this one, the rows that fall outside are dropped.
+func (f *film) merge(o *film) {
+	for y := 0; y < o.height; y++ {
+		py := o.y0 + y - f.y0
+		if py < 0 || py >= f.height {
+			continue
+		}
+
+		for x := 0; x < f.width; x++ {
+			i := py*f.width + x
+			j := y*o.width + x
+			f.col[i] = f.col[i].add(o.col[j])
+			f.weight[i] += o.weight[j]
+		}
+	}
+}
+
+func (f *film) image() *image.NRGBA {
+	rgba := image.NewNRGBA(image.Rect(0, 0, f.width, f.height))
+
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			i := y*f.width + x
+
+			// Filters with negative lobes can give a weight of zero or less, just leave those black.
+			col := vec3{}
+			if f.weight[i] > 0.0 {
+				col = f.col[i].divScalar(f.weight[i])
+			}
+
+			rgba.SetNRGBA(x, y, color.NRGBA{
+				toByte(col.x),
+				toByte(col.y),
+				toByte(col.z),
+				255,
+			})
+		}
+	}
+
+	return rgba
+}
+
+// Sharp filters can overshoot, so clamp before converting.
+func toByte(c float64) uint8 {
+	return uint8(math.Max(0.0, math.Min(1.0, c)) * 255.0)
+}
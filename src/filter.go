@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// A filter decides how much a sample counts for the pixels around it. All our filters
+// are separable, so the weight of a sample is eval(dx) * eval(dy).
+type filter interface {
+	radius() float64
+	eval(x float64) float64
+}
+
+// How far every filter reaches when no radius is given, the wider ones need it to do anything useful.
+var filterRadii = map[string]float64{
+	"box":      0.5,
+	"tent":     1.0,
+	"gaussian": 1.5,
+	"mitchell": 2.0,
+	"lanczos":  3.0,
+}
+
+// Makes the filter with a name, a radius of zero or less uses the one that fits it.
+func newFilter(name string, r float64) (filter, error) {
+	if r <= 0.0 {
+		r = filterRadii[name]
+	}
+
+	switch name {
+	case "box":
+		return boxFilter(r), nil
+	case "tent":
+		return tentFilter(r), nil
+	case "gaussian":
+		return gaussFilter(r, 2.0), nil
+	case "mitchell":
+		return mitchellFilter(r, 1.0/3.0, 1.0/3.0), nil
+	case "lanczos":
+		return lanczosFilter(r), nil
+	}
+
+	return nil, fmt.Errorf("unknown filter %q, use: box, tent, gaussian, mitchell or lanczos", name)
+}
+
+// Every sample counts the same, with a radius of 0.5 this is the plain average we used to do.
+type boxFlt struct {
+	r float64
+}
+
+func boxFilter(r float64) filter {
+	return boxFlt{r}
+}
+
+func (f boxFlt) radius() float64 {
+	return f.r
+}
+
+func (f boxFlt) eval(x float64) float64 {
+	// Half open, so a sample on the edge of two pixels only counts once.
+	if x >= -f.r && x < f.r {
+		return 1.0
+	}
+	return 0.0
+}
+
+// Falls off linearly from the center.
+type tentFlt struct {
+	r float64
+}
+
+func tentFilter(r float64) filter {
+	return tentFlt{r}
+}
+
+func (f tentFlt) radius() float64 {
+	return f.r
+}
+
+func (f tentFlt) eval(x float64) float64 {
+	return math.Max(0.0, f.r-math.Abs(x))
+}
+
+// Gaussian, shifted down so it reaches zero at the radius.
+type gaussFlt struct {
+	r, alpha, edge float64
+}
+
+func gaussFilter(r, alpha float64) filter {
+	return gaussFlt{r, alpha, math.Exp(-alpha * r * r)}
+}
+
+func (f gaussFlt) radius() float64 {
+	return f.r
+}
+
+func (f gaussFlt) eval(x float64) float64 {
+	return math.Max(0.0, math.Exp(-f.alpha*x*x)-f.edge)
+}
+
+// Mitchell-Netravali, b and c trade blurring against ringing, 1/3 for both is what they recommend.
+type mitchellFlt struct {
+	r, b, c float64
+}
+
+func mitchellFilter(r, b, c float64) filter {
+	return mitchellFlt{r, b, c}
+}
+
+func (f mitchellFlt) radius() float64 {
+	return f.r
+}
+
+func (f mitchellFlt) eval(x float64) float64 {
+	// The filter itself goes from -2 to 2, so scale it to our radius.
+	x = math.Abs(2.0 * x / f.r)
+	b, c := f.b, f.c
+
+	if x >= 2.0 {
+		return 0.0
+	}
+	if x > 1.0 {
+		return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6.0
+	}
+	return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6.0
+}
+
+// Windowed sinc, the sharpest of the bunch but it can ring around bright edges.
+type lanczosFlt struct {
+	r float64
+}
+
+func lanczosFilter(r float64) filter {
+	return lanczosFlt{r}
+}
+
+func (f lanczosFlt) radius() float64 {
+	return f.r
+}
+
+func (f lanczosFlt) eval(x float64) float64 {
+	if math.Abs(x) >= f.r {
+		return 0.0
+	}
+	return sinc(x) * sinc(x/f.r)
+}
+
+func sinc(x float64) float64 {
+	if math.Abs(x) < 1e-5 {
+		return 1.0
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
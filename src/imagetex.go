@@ -0,0 +1,324 @@
+package main
+
+import (
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+)
+
+// How the texture is looked up between the pixels.
+const (
+	texNearest  uint8 = 0
+	texBilinear uint8 = 1
+	texBicubic  uint8 = 2
+
+	// These blur the texture as much as the pixel covers of it, so it doesn't flicker in the distance.
+	// They need ray differentials, without them they're the same as bilinear.
+	texTrilinear uint8 = 3
+	texEWA       uint8 = 4 // Elliptical, stays sharp when looking at the texture at a steep angle.
+)
+
+// The most an EWA footprint can be stretched, longer ones are made wider so they don't take forever.
+const maxAnisotropy = 8.0
+
+// What the numbers in the file mean. Textures are used as they are unless they say they're sRGB.
+const (
+	colorLinear uint8 = 0 // Data like bump and normal maps, and float images.
+	colorSRGB   uint8 = 1 // Most 8-bit color images, they're made linear before rendering.
+)
+
+// What happens outside of the 0 to 1 UV range.
+const (
+	wrapClamp  uint8 = 0 // Use the pixel at the edge.
+	wrapRepeat uint8 = 1 // Tile the texture.
+	wrapMirror uint8 = 2 // Tile the texture, but flip every other tile.
+)
+
+type imageTex struct {
+	nx, ny int
+	img    *texImage // The pixels and the smaller mip levels, shared by every texture of the same file.
+	filter uint8
+	wrap   uint8
+	space  uint8
+
+	// The UVs are rotated (in radians), scaled and then moved.
+	offsetU, offsetV float64
+	scaleU, scaleV   float64
+	rotation         float64
+}
+
+// The file is loaded when the texture is first used, and only once for every file.
+func createImageTex(name string) *imageTex {
+	img := textures.get(name, false)
+	nx, ny := img.size(0)
+
+	return &imageTex{
+		nx: nx, ny: ny, img: img,
+		filter: texNearest, wrap: wrapClamp, scaleU: 1.0, scaleV: 1.0,
+	}
+}
+
+// Sets the filter, like texBilinear, and returns the texture so calls can be chained.
+func (t *imageTex) filtered(filter uint8) *imageTex {
+	t.filter = filter
+	return t
+}
+
+// Sets the color space, like colorSRGB. The smaller mip levels depend on it, so it's another image in the cache.
+func (t *imageTex) colorSpace(space uint8) *imageTex {
+	t.space = space
+	t.img = textures.get(t.img.path, space == colorSRGB)
+	return t
+}
+
+// Sets the wrap mode, like wrapRepeat.
+func (t *imageTex) wrapped(wrap uint8) *imageTex {
+	t.wrap = wrap
+	return t
+}
+
+// The UVs are rotated by deg degrees around 0, 0, then scaled and moved. A scale of 4 repeats the texture 4 times.
+func (t *imageTex) uvTransform(offsetU, offsetV, scaleU, scaleV, deg float64) *imageTex {
+	t.offsetU = offsetU
+	t.offsetV = offsetV
+	t.scaleU = scaleU
+	t.scaleV = scaleV
+	t.rotation = deg * math.Pi / 180.0
+	return t
+}
+
+func (t *imageTex) transformUV(u, v float64) (float64, float64) {
+	if t.rotation != 0.0 {
+		sin, cos := math.Sincos(t.rotation)
+		u, v = cos*u-sin*v, sin*u+cos*v
+	}
+
+	return u*t.scaleU + t.offsetU, v*t.scaleV + t.offsetV
+}
+
+func (t *imageTex) value(u, v float64, p vec3) vec3 {
+	u, v = t.transformUV(u, v)
+
+	switch t.filter {
+	case texBilinear, texTrilinear, texEWA:
+		return t.bilinear(0, u, v)
+	case texBicubic:
+		return t.bicubic(u, v)
+	default:
+		i := int(math.Floor(u * float64(t.nx)))
+		j := int(math.Floor((1.0-v)*float64(t.ny) - 0.001))
+		return t.texel(0, i, j)
+	}
+}
+
+// Looks up the texture over the footprint of the pixel, when the filter needs it.
+func (t *imageTex) valueAt(hr *hitRecord) vec3 {
+	if t.filter != texTrilinear && t.filter != texEWA {
+		return t.value(hr.u, hr.v, hr.p)
+	}
+
+	u, v := t.transformUV(hr.u, hr.v)
+	dudx, dvdx := t.transformDeriv(hr.dudx, hr.dvdx)
+	dudy, dvdy := t.transformDeriv(hr.dudy, hr.dvdy)
+
+	if t.filter == texEWA {
+		return t.ewa(u, v, dudx, dvdx, dudy, dvdy)
+	}
+	return t.trilinear(u, v, math.Max(math.Max(math.Abs(dudx), math.Abs(dvdx)), math.Max(math.Abs(dudy), math.Abs(dvdy))))
+}
+
+// The UV transform without the offset, for the derivatives.
+func (t *imageTex) transformDeriv(du, dv float64) (float64, float64) {
+	if t.rotation != 0.0 {
+		sin, cos := math.Sincos(t.rotation)
+		du, dv = cos*du-sin*dv, sin*du+cos*dv
+	}
+
+	return du * t.scaleU, dv * t.scaleV
+}
+
+// The level where a pixel of the texture is width (in UV space) big, it's not a whole number.
+func (t *imageTex) level(width float64) float64 {
+	size := float64(t.nx)
+	if t.ny > t.nx {
+		size = float64(t.ny)
+	}
+
+	l := math.Log2(math.Max(width*size, 1e-8))
+	return math.Max(0.0, math.Min(float64(t.img.levels()-1), l))
+}
+
+// Blends bilinear lookups in the two levels around the footprint size.
+func (t *imageTex) trilinear(u, v, width float64) vec3 {
+	l := t.level(2.0 * width)
+	l0 := int(math.Floor(l))
+	if l0 >= t.img.levels()-1 {
+		return t.bilinear(l0, u, v)
+	}
+
+	f := l - float64(l0)
+	return t.bilinear(l0, u, v).mulScalar(1.0 - f).add(t.bilinear(l0+1, u, v).mulScalar(f))
+}
+
+// Elliptically weighted average, the footprint of the pixel is an ellipse with the two derivatives as its axes.
+func (t *imageTex) ewa(u, v, dudx, dvdx, dudy, dvdy float64) vec3 {
+	// Image rows go down, so v is flipped.
+	s, r := u, 1.0-v
+	ds0, dr0 := dudx, -dvdx
+	ds1, dr1 := dudy, -dvdy
+
+	major := math.Hypot(ds0, dr0)
+	minor := math.Hypot(ds1, dr1)
+	if minor > major {
+		ds0, dr0, ds1, dr1 = ds1, dr1, ds0, dr0
+		major, minor = minor, major
+	}
+
+	// Really long ellipses cover too many pixels, make them a bit wider so a smaller level is used.
+	if minor > 0.0 && minor*maxAnisotropy < major {
+		scale := major / (minor * maxAnisotropy)
+		ds1 *= scale
+		dr1 *= scale
+		minor *= scale
+	}
+	if minor == 0.0 {
+		return t.bilinear(0, u, v)
+	}
+
+	// The minor axis decides the level, with the major axis that would be too blurry.
+	l := t.level(minor)
+	l0 := int(math.Floor(l))
+	if l0 >= t.img.levels()-1 {
+		return t.ewaLevel(l0, s, r, ds0, dr0, ds1, dr1)
+	}
+
+	f := l - float64(l0)
+	c0 := t.ewaLevel(l0, s, r, ds0, dr0, ds1, dr1)
+	c1 := t.ewaLevel(l0+1, s, r, ds0, dr0, ds1, dr1)
+	return c0.mulScalar(1.0 - f).add(c1.mulScalar(f))
+}
+
+// Adds up the pixels of a level inside the ellipse, with a gaussian falloff towards the edge.
+func (t *imageTex) ewaLevel(level int, s, r, ds0, dr0, ds1, dr1 float64) vec3 {
+	nw, nh := t.img.size(level)
+	w, h := float64(nw), float64(nh)
+
+	// Into pixels of this level.
+	s = s*w - 0.5
+	r = r*h - 0.5
+	ds0, ds1 = ds0*w, ds1*w
+	dr0, dr1 = dr0*h, dr1*h
+
+	// The ellipse as a*x^2 + b*x*y + c*y^2 < 1, the ones make sure it covers at least a pixel.
+	a := dr0*dr0 + dr1*dr1 + 1.0
+	b := -2.0 * (ds0*dr0 + ds1*dr1)
+	c := ds0*ds0 + ds1*ds1 + 1.0
+	invF := 1.0 / (a*c - b*b*0.25)
+	a *= invF
+	b *= invF
+	c *= invF
+
+	// The box around the ellipse.
+	det := -b*b + 4.0*a*c
+	sr := 2.0 * math.Sqrt(det*c) / det
+	rr := 2.0 * math.Sqrt(det*a) / det
+	s0, s1 := int(math.Ceil(s-sr)), int(math.Floor(s+sr))
+	r0, r1 := int(math.Ceil(r-rr)), int(math.Floor(r+rr))
+
+	sum := vec3{}
+	weight := 0.0
+	for j := r0; j <= r1; j++ {
+		y := float64(j) - r
+		for i := s0; i <= s1; i++ {
+			x := float64(i) - s
+			d := a*x*x + b*x*y + c*y*y
+			if d < 1.0 {
+				wt := math.Exp(-2.0*d) - math.Exp(-2.0)
+				sum = sum.add(t.texel(level, i, j).mulScalar(wt))
+				weight += wt
+			}
+		}
+	}
+
+	if weight <= 0.0 {
+		return t.texel(level, int(math.Floor(s+0.5)), int(math.Floor(r+0.5)))
+	}
+	return sum.divScalar(weight)
+}
+
+// Blends the four pixels of a level around u, v.
+func (t *imageTex) bilinear(level int, u, v float64) vec3 {
+	// Pixel centers are at half pixels.
+	w, h := t.img.size(level)
+	x := u*float64(w) - 0.5
+	y := (1.0-v)*float64(h) - 0.5
+	i := int(math.Floor(x))
+	j := int(math.Floor(y))
+	fx := x - float64(i)
+	fy := y - float64(j)
+
+	top := t.texel(level, i, j).mulScalar(1.0 - fx).add(t.texel(level, i+1, j).mulScalar(fx))
+	bottom := t.texel(level, i, j+1).mulScalar(1.0 - fx).add(t.texel(level, i+1, j+1).mulScalar(fx))
+	return top.mulScalar(1.0 - fy).add(bottom.mulScalar(fy))
+}
+
+// Blends the sixteen pixels around u, v with a Catmull-Rom spline, it's sharper than bilinear.
+func (t *imageTex) bicubic(u, v float64) vec3 {
+	x := u*float64(t.nx) - 0.5
+	y := (1.0-v)*float64(t.ny) - 0.5
+	i := int(math.Floor(x))
+	j := int(math.Floor(y))
+	wx := cubicWeights(x - float64(i))
+	wy := cubicWeights(y - float64(j))
+
+	col := vec3{}
+	for b := 0; b < 4; b++ {
+		row := vec3{}
+		for a := 0; a < 4; a++ {
+			row = row.add(t.texel(0, i+a-1, j+b-1).mulScalar(wx[a]))
+		}
+		col = col.add(row.mulScalar(wy[b]))
+	}
+
+	// The spline can overshoot a little around sharp edges.
+	return vec(math.Max(0.0, col.x), math.Max(0.0, col.y), math.Max(0.0, col.z))
+}
+
+// Catmull-Rom weights for the four pixels around f.
+func cubicWeights(f float64) [4]float64 {
+	f2 := f * f
+	f3 := f2 * f
+	return [4]float64{
+		0.5 * (-f3 + 2.0*f2 - f),
+		0.5 * (3.0*f3 - 5.0*f2 + 2.0),
+		0.5 * (-3.0*f3 + 4.0*f2 + f),
+		0.5 * (f3 - f2),
+	}
+}
+
+// The color of pixel i, j of a level, pixels outside of the image are handled by the wrap mode.
+func (t *imageTex) texel(level, i, j int) vec3 {
+	w, h := t.img.size(level)
+	return t.img.texel(level, wrapIndex(i, w, t.wrap), wrapIndex(j, h, t.wrap))
+}
+
+func wrapIndex(i, n int, wrap uint8) int {
+	switch wrap {
+	case wrapRepeat:
+		return ((i % n) + n) % n
+	case wrapMirror:
+		i = ((i % (2 * n)) + 2*n) % (2 * n)
+		if i >= n {
+			i = 2*n - 1 - i
+		}
+		return i
+	default:
+		if i < 0 {
+			return 0
+		}
+		if i > n-1 {
+			return n - 1
+		}
+		return i
+	}
+}
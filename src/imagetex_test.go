@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// The UVs of the center of pixel x, y, with y going down from the top of the image.
+func pixelUV(x, y float64) (float64, float64) {
+	return (x + 0.5) / 256.0, 1.0 - (y+0.5)/256.0
+}
+
+// The test texture has x in red and y in green, so the lookup should give back where it landed.
+func checkLookup(t *testing.T, what string, tex *imageTex, u, v, x, y float64) {
+	t.Helper()
+	c := tex.value(u, v, vec3{})
+	if math.Abs(c.x*255.0-x) > 1e-6 || math.Abs(c.y*255.0-y) > 1e-6 {
+		t.Errorf("%s at %v, %v gave pixel %v, %v, want %v, %v", what, u, v, c.x*255.0, c.y*255.0, x, y)
+	}
+}
+
+func TestImageTexFilters(t *testing.T) {
+	name := writeTestTexture(t)
+
+	nearest := createImageTex(name)
+	for _, p := range [][2]float64{{0, 0}, {10, 20}, {255, 255}, {128, 3}} {
+		u, v := pixelUV(p[0], p[1])
+		checkLookup(t, "nearest", nearest, u, v, p[0], p[1])
+	}
+
+	// The texture is linear, so both blends land exactly between the pixels.
+	bilinear := createImageTex(name).filtered(texBilinear)
+	bicubic := createImageTex(name).filtered(texBicubic)
+	for _, tex := range []*imageTex{bilinear, bicubic} {
+		u, v := pixelUV(10.0, 20.0)
+		checkLookup(t, "pixel center", tex, u, v, 10.0, 20.0)
+		u, v = pixelUV(10.5, 20.0)
+		checkLookup(t, "between two pixels", tex, u, v, 10.5, 20.0)
+		u, v = pixelUV(40.25, 60.75)
+		checkLookup(t, "between four pixels", tex, u, v, 40.25, 60.75)
+	}
+}
+
+func TestImageTexWrap(t *testing.T) {
+	name := writeTestTexture(t)
+	clamp := createImageTex(name)
+	repeat := createImageTex(name).wrapped(wrapRepeat)
+	mirror := createImageTex(name).wrapped(wrapMirror)
+
+	u, v := pixelUV(64.0, 30.0)
+	checkLookup(t, "clamp right", clamp, u+1.0, v, 255.0, 30.0)
+	checkLookup(t, "clamp left", clamp, u-1.0, v, 0.0, 30.0)
+	checkLookup(t, "repeat right", repeat, u+1.0, v, 64.0, 30.0)
+	checkLookup(t, "repeat left", repeat, u-2.0, v, 64.0, 30.0)
+	checkLookup(t, "mirror right", mirror, u+1.0, v, 191.0, 30.0)
+	checkLookup(t, "mirror twice", mirror, u+2.0, v, 64.0, 30.0)
+	checkLookup(t, "mirror below", mirror, u, v-1.0, 64.0, 225.0)
+
+	cases := []struct {
+		i, n int
+		wrap uint8
+		want int
+	}{
+		{-1, 4, wrapClamp, 0}, {5, 4, wrapClamp, 3},
+		{-1, 4, wrapRepeat, 3}, {9, 4, wrapRepeat, 1},
+		{-1, 4, wrapMirror, 0}, {4, 4, wrapMirror, 3}, {-5, 4, wrapMirror, 3}, {9, 4, wrapMirror, 1},
+	}
+	for _, c := range cases {
+		if got := wrapIndex(c.i, c.n, c.wrap); got != c.want {
+			t.Errorf("wrapIndex(%d, %d, %d) = %d, want %d", c.i, c.n, c.wrap, got, c.want)
+		}
+	}
+}
+
+func TestImageTexUVTransform(t *testing.T) {
+	name := writeTestTexture(t)
+
+	// Scaled by 2 the texture fits twice, the second copy starts halfway.
+	scaled := createImageTex(name).wrapped(wrapRepeat).uvTransform(0.0, 0.0, 2.0, 1.0, 0.0)
+	u, v := pixelUV(40.0, 30.0)
+	checkLookup(t, "scaled", scaled, u/2.0, v, 40.0, 30.0)
+	checkLookup(t, "scaled second copy", scaled, u/2.0+0.5, v, 40.0, 30.0)
+
+	moved := createImageTex(name).uvTransform(0.25, 0.0, 1.0, 1.0, 0.0)
+	checkLookup(t, "moved", moved, u-0.25, v, 40.0, 30.0)
+
+	// A quarter turn first, then the scale and the offset.
+	tex := createImageTex(name).uvTransform(0.1, 0.2, 2.0, 4.0, 90.0)
+	if u, v := tex.transformUV(0.25, 0.5); math.Abs(u+0.9) > 1e-9 || math.Abs(v-1.2) > 1e-9 {
+		t.Errorf("transformed UVs are %v, %v, want -0.9, 1.2", u, v)
+	}
+	if du, dv := tex.transformDeriv(0.25, 0.5); math.Abs(du+1.0) > 1e-9 || math.Abs(dv-1.0) > 1e-9 {
+		t.Errorf("transformed derivatives are %v, %v, want -1, 1", du, dv)
+	}
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"image/png"
-	"math/rand"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/trace"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -20,10 +22,50 @@ import (
 )
 
 var (
-	samples = 100
-	width   = 1000
-	height  = 500
-	numCPU  = runtime.NumCPU()
+	samples   = 100
+	width     = 1000 // Resolution for new cameras.
+	height    = 500
+	numCPU    = runtime.NumCPU()
+	smpName   = "sobol"
+	smpMethod = smpSobol
+	seed      = int64(1)
+
+	// Pixel reconstruction filter, a box with a radius of half a pixel is a plain average.
+	// Zero radius means the filter uses its own.
+	filterName   = "box"
+	filterRadius = 0.0
+	pixelFilter  filter
+
+	// Camera overrides, zero or empty means we use what the scene says.
+	projection  = ""
+	fov         = 0.0
+	orthoWidth  = 0.0
+	fisheye     = "equidistant"
+	focusDist   = 0.0
+	autofocus   = ""
+	focalLength = 0.0
+	fStop       = 0.0
+	blades      = 0
+	bladeAngle  = 0.0
+	apertureImg = ""
+	shutter     = ""
+	shutterRamp = 0.0
+	shutterVals = ""
+	rolling     = 0.0
+
+	// Stereo rendering, the mode can be: sbs (side by side), tb (top bottom) or separate.
+	stereoMode  = ""
+	iod         = 0.065
+	convergence = 0.0
+
+	// Renders the frames from first to last of the camera path, like: 0:59
+	frames = ""
+
+	// Memory for image textures in megabytes, zero means there's no limit.
+	texMemory = 0
+
+	// Traces wavelengths instead of RGB, so glass can split light into colors.
+	spectral = false
 )
 
 // Check is used for handling errors.
@@ -68,57 +110,176 @@ func saveFile(fileName string, img image.Image) error {
 	return fmt.Errorf("file format not supported, use: png, bmp or jpg")
 }
 
-func render(scn *scene) image.Image {
+// Renders the scene as seen by c, the image gets the resolution of the camera.
+func render(scn *scene, c *camera) image.Image {
 	fmt.Println("Number of samples:", samples)
+	width, height := c.width, c.height
 
-	// The surface or rectangle for the image.
-	rect := image.Rect(0, 0, width, height)
-	rgba := image.NewNRGBA(rect)
+	// The film for the whole image, the rows are added to it as soon as they're done.
+	img := newFilm(width, 0, height)
+	rows := make(chan *film, height)
 
-	// Create goroutines for each row.
-	var w sync.WaitGroup
-	w.Add(height)
+	// A sample can land on the pixels within the radius of the filter, so every row
+	// needs a few rows above and below it.
+	border := int(math.Ceil(pixelFilter.radius() + 0.5))
 
 	// Loop through each pixel from left to write. cx and cy being the current x and y respectively.
 	for cy := 0; cy < height; cy++ {
 		go func(cy int) {
-			// Create a rand.Rand interface for each goroutine to prevent locking and unlocking.
-			// Give it a seed by generating a random number, time can be used but this gave a weird effect.
-			rnd := rand.New(rand.NewSource(rand.Int63()))
+			// Create a sampler for each goroutine to prevent locking and unlocking.
+			// Every row gets its own stream of the seed, so it doesn't matter which goroutine runs first.
+			rnd := newSampler(smpMethod, samples, seed, cy)
+			row := newFilm(width, cy-border, 2*border+1)
 
 			for cx := 0; cx < width; cx++ {
-				// Starting point for each pixel.
-				col := vec3{0.0, 0.0, 0.0}
+				rnd.startPixel(cx, cy)
+
 				for i := 0; i < samples; i++ {
+					rnd.startSample(i)
+
 					// Add a bit of randomness, so the background will blend more with the edges of objects.
 					// This will prevent lines from looking jaggy.
-					s := (float64(cx) + rnd.Float64()) / float64(width)
-					t := (float64(cy) + rnd.Float64()) / float64(height)
+					jx, jy := rnd.get2D()
+					fx := float64(cx) + jx
+					fy := float64(cy) + jy
 
-					r := scn.cam.ray(s, t, rnd)
-					col = col.add(r.color(scn, 0, rnd))
-				}
-				// Divide by the amount of samples to get the average.
-				col = col.divScalar(float64(samples))
-				finalCol := color.NRGBA{
-					uint8(col.x * 255.0),
-					uint8(col.y * 255.0),
-					uint8(col.z * 255.0),
-					255,
+					s := fx / float64(width)
+					t := fy / float64(height)
+
+					// Parts of the image the camera doesn't see stay black.
+					col := vec3{}
+					if c.covers(s, t) {
+						r := c.ray(s, t, rnd)
+						if spectral {
+							col = r.spectralColor(scn, rnd)
+						} else {
+							col = r.color(scn, 0, rnd)
+						}
+					}
+					row.splat(fx, fy, col, pixelFilter)
 				}
-				rgba.SetNRGBA(cx, cy, finalCol)
 			}
-			w.Done()
+			rows <- row
 		}(cy)
 	}
-	w.Wait()
-	return rgba
+
+	// Add the rows in order, the ones that finish early wait until it's their turn.
+	done := make([]*film, height)
+	next := 0
+	for i := 0; i < height; i++ {
+		row := <-rows
+		done[row.y0+border] = row
+		for next < height && done[next] != nil {
+			img.merge(done[next])
+			done[next] = nil
+			next++
+		}
+	}
+
+	return img.image()
+}
+
+// Applies the camera settings that were passed on the command line to c, a camera of scn.
+// For animations this happens for every frame, after the camera path moved the camera.
+func setupCamera(scn *scene, c *camera) {
+	if fov > 0.0 && projection != "fisheye" {
+		c.setFov(fov)
+	}
+	switch projection {
+	case "", "perspective":
+	case "ortho":
+		c.setOrtho(orthoWidth)
+	case "equirect":
+		c.setEquirect()
+	case "fisheye":
+		model, err := fisheyeModelNamed(fisheye)
+		check(err)
+		c.setFisheye(fov, model)
+	default:
+		check(fmt.Errorf("unknown projection %q, use: perspective, ortho, equirect or fisheye", projection))
+	}
+	if focalLength > 0.0 {
+		c.setFocalLength(focalLength)
+	}
+	if fStop > 0.0 {
+		c.setFStop(fStop)
+	}
+	if blades > 0 {
+		c.setAperture(polyAp(blades, bladeAngle))
+	}
+	if apertureImg != "" {
+		c.setAperture(imageAp(apertureImg))
+	}
+	if shutter != "" {
+		var open, close float64
+		_, err := fmt.Sscanf(shutter, "%g,%g", &open, &close)
+		check(err)
+		c.setShutter(open, close)
+	}
+	if shutterRamp > 0.0 {
+		c.setShutterCurve(trapezoidShutter(shutterRamp))
+	}
+	if shutterVals != "" {
+		var values []float64
+		for _, f := range strings.Split(shutterVals, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+			check(err)
+			values = append(values, v)
+		}
+		c.setShutterCurve(tabulatedShutter(values...))
+	}
+	if rolling > 0.0 {
+		c.setRollingShutter(rolling)
+	}
+	if focusDist > 0.0 {
+		c.setFocus(focusDist)
+	}
+	if autofocus != "" {
+		var px, py int
+		_, err := fmt.Sscanf(autofocus, "%d,%d", &px, &py)
+		check(err)
+
+		if c.autofocus(scn, px, py) {
+			fmt.Println("Focus distance:", c.focusDist)
+		} else {
+			fmt.Println("Nothing to focus on at", autofocus)
+		}
+	}
 }
 
 func main() {
+	flag.StringVar(&smpName, "sampler", smpName, "sampler: independent, stratified, halton or sobol")
+	flag.Int64Var(&seed, "seed", seed, "seed for all random numbers, the same seed gives the same image")
+	flag.StringVar(&filterName, "filter", filterName, "pixel filter: box, tent, gaussian, mitchell or lanczos")
+	flag.Float64Var(&filterRadius, "filter-radius", filterRadius, "radius of the pixel filter in pixels, every filter has its own by default")
+	flag.StringVar(&projection, "projection", projection, "camera projection: perspective, ortho, equirect (use a 2:1 image) or fisheye")
+	flag.Float64Var(&fov, "fov", fov, "vertical field of view in degrees, for a fisheye the angle of the whole circle (180 by default)")
+	flag.StringVar(&fisheye, "fisheye", fisheye, "fisheye model: equidistant or equisolid")
+	flag.Float64Var(&orthoWidth, "ortho-width", orthoWidth, "width of the view of an orthographic camera in scene units, zero shows what the scene camera sees")
+	flag.Float64Var(&focusDist, "focus", focusDist, "focus distance, overrides the one of the scene")
+	flag.StringVar(&autofocus, "autofocus", autofocus, "focus on whatever is at this pixel, like: 500,250")
+	flag.Float64Var(&focalLength, "focal-length", focalLength, "focal length in mm on a full frame sensor, overrides the field of view")
+	flag.Float64Var(&fStop, "fstop", fStop, "f-number of the lens, overrides the aperture")
+	flag.IntVar(&blades, "blades", blades, "number of aperture blades, for polygonal bokeh")
+	flag.Float64Var(&bladeAngle, "blade-rotation", bladeAngle, "rotation of the aperture blades in degrees")
+	flag.StringVar(&apertureImg, "aperture-image", apertureImg, "grayscale image with the shape of the aperture, for custom bokeh")
+	flag.StringVar(&shutter, "shutter", shutter, "times the shutter opens and closes, like: 0.25,0.75")
+	flag.Float64Var(&shutterRamp, "shutter-ramp", shutterRamp, "part of the shutter time spent opening and closing, from 0 to 0.5")
+	flag.StringVar(&shutterVals, "shutter-curve", shutterVals, "how much light the shutter lets through, spread evenly over the time it's open, like: 0,1,1,0.5")
+	flag.Float64Var(&rolling, "rolling", rolling, "readout time of a rolling shutter, from the top to the bottom row")
+	flag.StringVar(&stereoMode, "stereo", stereoMode, "render both eyes: sbs (side by side), tb (top bottom) or separate (two files)")
+	flag.Float64Var(&iod, "iod", iod, "distance between the eyes for stereo")
+	flag.Float64Var(&convergence, "convergence", convergence, "distance where the eyes converge for stereo, zero uses the focus distance (parallel for panoramic cameras)")
+	flag.StringVar(&frames, "frames", frames, "render the frames of the camera path from first to last, like: 0:59")
+	// Files can only be read whole, so when the textures used at the same time don't fit every miss reads a file again.
+	// Keep it well above what a frame needs, it's meant to keep unused textures and far away levels out of memory.
+	flag.IntVar(&texMemory, "tex-mem", texMemory, "memory for image textures in MB, the least recently used parts are thrown away above it (too little reads the files over and over)")
+	flag.BoolVar(&spectral, "spectral", spectral, "trace wavelengths instead of RGB, for dispersion in glass")
+	flag.Parse()
+
 	// Check if we have enough arguments, if not tell the user he should pass a file name.
-	if len(os.Args) < 2 {
-		err := fmt.Errorf("not enough arguments, usage:\n render test.png")
+	if flag.NArg() < 1 {
+		err := fmt.Errorf("not enough arguments, usage:\n render [flags] test.png")
 		panic(err)
 	}
 
@@ -139,9 +300,23 @@ func main() {
 	// Let the user know how many threads it is using.
 	fmt.Println("Number of threads available:", numCPU)
 
-	// Image dimensions
-	fmt.Println("Image width:", width)
-	fmt.Println("Image height:", height)
+	fmt.Println("Seed:", seed)
+
+	smpMethod, err = samplerMethod(smpName)
+	check(err)
+	fmt.Println("Sampler:", smpName)
+
+	pixelFilter, err = newFilter(filterName, filterRadius)
+	check(err)
+	fmt.Println("Filter:", filterName, "with radius", pixelFilter.radius())
+
+	if texMemory > 0 {
+		textures.setLimit(int64(texMemory) << 20)
+		fmt.Println("Texture memory:", texMemory, "MB")
+	}
+	if spectral {
+		fmt.Println("Spectral rendering with", numWavelengths, "wavelengths per path")
+	}
 	/*
 	   // List of objects.
 	   objList := []*object{
@@ -156,16 +331,106 @@ func main() {
 	// Get the current time, use this to get the elapsed time later.
 	startTimeGo := time.Now()
 
-	img := render(randScene())
+	scn := randScene(seed)
+	setupCamera(scn, scn.cam)
 
-	// Print how long it took to raycast.
-	elapsedGo := time.Since(startTimeGo)
-	fmt.Println("Time spent raycasting:", elapsedGo.Seconds(), "s")
+	// Image dimensions
+	fmt.Println("Image width:", scn.cam.width)
+	fmt.Println("Image height:", scn.cam.height)
+
+	// The objects stay the same for every frame and eye, so one BVH is enough.
+	t0, t1 := scn.cam.timeRange()
+	scn.build(t0, t1)
+
+	if frames == "" {
+		renderTo(scn, scn.cam, flag.Arg(0))
+		printElapsed(startTimeGo)
+		return
+	}
+
+	var first, last int
+	_, err = fmt.Sscanf(frames, "%d:%d", &first, &last)
+	check(err)
+	if scn.path == nil {
+		panic(fmt.Errorf("the scene doesn't have a camera path to animate"))
+	}
+
+	for f := first; f <= last; f++ {
+		fmt.Println("Frame:", f)
+		c := scn.path.at(scn.cam, float64(f))
+		setupCamera(scn, c)
+		renderTo(scn, c, frameName(flag.Arg(0), f))
+	}
+	printElapsed(startTimeGo)
+}
+
+// Renders what c sees and saves it, for stereo this renders both eyes.
+func renderTo(scn *scene, c *camera, fileName string) {
+	var err error
 
-	// Flip the image because we want 0, 0 to be the bottom left.
-	img = imaging.FlipV(img)
+	if stereoMode == "" {
+		// Save the file to the destination given in the argument.
+		err = saveFile(fileName, renderImage(scn, c))
+		check(err)
+		return
+	}
+
+	left, right := c.stereoPair(iod, convergence)
+	leftImg := renderImage(scn, left)
+	rightImg := renderImage(scn, right)
 
-	// Save the file to the destination given in the argument.
-	err = saveFile(os.Args[1], img)
+	switch stereoMode {
+	case "sbs":
+		img := imaging.New(left.width+right.width, left.height, color.Black)
+		img = imaging.Paste(img, leftImg, image.Pt(0, 0))
+		img = imaging.Paste(img, rightImg, image.Pt(left.width, 0))
+		err = saveFile(fileName, img)
+	case "tb":
+		img := imaging.New(left.width, left.height+right.height, color.Black)
+		img = imaging.Paste(img, leftImg, image.Pt(0, 0))
+		img = imaging.Paste(img, rightImg, image.Pt(0, left.height))
+		err = saveFile(fileName, img)
+	case "separate":
+		err = saveFile(eyeName(fileName, "left"), leftImg)
+		check(err)
+		err = saveFile(eyeName(fileName, "right"), rightImg)
+	default:
+		err = fmt.Errorf("unknown stereo mode %q, use: sbs, tb or separate", stereoMode)
+	}
 	check(err)
 }
+
+// Renders the image and flips it, because we want 0, 0 to be the bottom left.
+func renderImage(scn *scene, c *camera) image.Image {
+	return imaging.FlipV(render(scn, c))
+}
+
+// Print how long it took to raycast.
+func printElapsed(start time.Time) {
+	elapsedGo := time.Since(start)
+	fmt.Println("Time spent raycasting:", elapsedGo.Seconds(), "s")
+}
+
+// The only format a file name of a frame can have, like %d or %04d.
+var frameVerb = regexp.MustCompile(`%(0[1-9][0-9]*)?d`)
+
+// Numbers the file of a frame. The name can have its own format like frame_%04d.png,
+// otherwise the number is added at the end, frame.png becomes frame_0001.png.
+func frameName(fileName string, frame int) string {
+	if strings.Contains(fileName, "%") {
+		loc := frameVerb.FindStringIndex(fileName)
+		if loc == nil || strings.Count(fileName, "%") != 1 {
+			panic(fmt.Errorf("the file name can only have one %%d or %%0Nd for the frame number, like frame_%%04d.png"))
+		}
+		return fileName[:loc[0]] + fmt.Sprintf(fileName[loc[0]:loc[1]], frame) + fileName[loc[1]:]
+	}
+
+	ext := filepath.Ext(fileName)
+	return fmt.Sprintf("%s_%04d%s", strings.TrimSuffix(fileName, ext), frame, ext)
+}
+
+// Adds the eye to the file name, test.png becomes test_left.png.
+func eyeName(fileName, eye string) string {
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "_" + eye + ext
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// A small scene like the random one, but without image textures so it doesn't need any files.
+func testScene(seed int64) *scene {
+	rnd := rand.New(rand.NewSource(seed))
+
+	objList := []*object{
+		sphere(1000.0, vec(0.0, -1000, 0.0), dif(checker(vec(0.2, 0.3, 0.1), vec(0.9, 0.9, 0.9)))),
+		sphere(1.0, vec(0.0, 1.0, 0.0), dif(perlTex(4.0, noiseFor(noiseClassic, seed)))),
+		sphere(1.0, vec(-4.0, 1.0, 0.0), met(col(0.7, 0.6, 0.5), 0.0)),
+		sphere(1.0, vec(4.0, 1.0, 0.0), glass(1.5)),
+	}
+	for i := 0; i < 8; i++ {
+		center := vec(-2.0+4.0*rnd.Float64(), 0.2, -2.0+4.0*rnd.Float64())
+		objList = append(objList, sphere(0.2, center, dif(col(rnd.Float64(), rnd.Float64(), rnd.Float64()))))
+	}
+
+	return &scene{cam: cam(vec(13.0, 2.0, 3.0), vec(0.0, 0.0, 0.0), 20.0, 0.15, 10.0, 1.0), objects: objList}
+}
+
+// Renders the scene small, so the tests don't take long. The seed is for the samplers.
+func renderSmall(t *testing.T, scn *scene, smpSeed int64) *image.NRGBA {
+	t.Helper()
+
+	oldSeed := seed
+	defer func() { seed = oldSeed }()
+	seed = smpSeed
+
+	scn.cam.setResolution(32, 16)
+	t0, t1 := scn.cam.timeRange()
+	scn.build(t0, t1)
+
+	img, ok := render(scn, scn.cam).(*image.NRGBA)
+	if !ok {
+		t.Fatal("render didn't give an NRGBA image")
+	}
+	return img
+}
+
+// The same seed has to give the same image, no matter how many threads there are.
+func TestRenderDeterministic(t *testing.T) {
+	oldSamples, oldFilter, oldProcs := samples, pixelFilter, runtime.GOMAXPROCS(0)
+	defer func() {
+		samples, pixelFilter = oldSamples, oldFilter
+		runtime.GOMAXPROCS(oldProcs)
+	}()
+	samples = 4
+	pixelFilter = boxFilter(0.5)
+
+	first := renderSmall(t, testScene(1), 1)
+	again := renderSmall(t, testScene(1), 1)
+	if !bytes.Equal(first.Pix, again.Pix) {
+		t.Error("two renders with the same seed are different")
+	}
+
+	runtime.GOMAXPROCS(1)
+	single := renderSmall(t, testScene(1), 1)
+	if !bytes.Equal(first.Pix, single.Pix) {
+		t.Error("the render depends on the number of threads")
+	}
+
+	if other := renderSmall(t, testScene(1), 2); bytes.Equal(first.Pix, other.Pix) {
+		t.Error("another seed for the samplers gives the same image")
+	}
+	if other := renderSmall(t, testScene(2), 1); bytes.Equal(first.Pix, other.Pix) {
+		t.Error("another seed for the scene gives the same image")
+	}
+}
+
+func TestFrameName(t *testing.T) {
+	names := map[string]string{
+		"frame.png":         "frame_0007.png",
+		"frame_%04d.png":    "frame_0007.png",
+		"shot%d_final.png":  "shot7_final.png",
+		"dir/%03d/take.png": "dir/007/take.png",
+	}
+	for name, want := range names {
+		if got := frameName(name, 7); got != want {
+			t.Errorf("frameName(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, name := range []string{"out%s_%d.png", "100%.png", "%d_%d.png", "frame_%4d.png", "frame_%00d.png"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("frameName(%q) should be rejected", name)
+				}
+			}()
+			frameName(name, 7)
+		}()
+	}
+}
@@ -1,14 +1,7 @@
 package main
 
 import (
-	"image"
-	"image/draw"
-	_ "image/jpeg"
-	_ "image/png"
 	"math"
-	"math/rand"
-	"os"
-	"path/filepath"
 )
 
 type material struct {
@@ -16,6 +9,28 @@ type material struct {
 	tex      texture
 	fuzz     float64
 	refIndex float64
+
+	// How much light glass absorbs per unit it travels inside, for every color.
+	absorption vec3
+
+	// Optional for glass, how the index changes with the wavelength. Only spectral mode can see it.
+	dispersion uint8
+	coeffs     [3]float64
+	poles      [3]float64
+
+	// Optional thin film on top, the thickness in nm. The texture makes the thickness vary.
+	film      float64
+	filmIndex float64
+	filmTex   texture
+
+	// Optional, they change the normal so the surface looks bumpy without changing its shape.
+	normalMap texture
+	bumpMap   texture
+	bumpScale float64
+
+	// Optional, rays go through the parts where it's dark.
+	opacity     texture
+	opacityMode uint8
 }
 
 const (
@@ -24,6 +39,13 @@ const (
 	matGlass   = 2
 )
 
+// How the index of glass depends on the wavelength.
+const (
+	dispersionNone      uint8 = 0
+	dispersionCauchy    uint8 = 1 // n = A + B/l^2 + C/l^4, simple and good enough for most glass.
+	dispersionSellmeier uint8 = 2 // n^2 = 1 + sum of B*l^2/(l^2-C), what the glass makers list.
+)
+
 func dif(tex texture) *material {
 	m := material{}
 
@@ -52,13 +74,82 @@ func glass(index float64) *material {
 	return &m
 }
 
-func (m *material) scatter(rIn ray, hr *hitRecord, atten *vec3, rOut *ray, rnd *rand.Rand) bool {
+// Glass that light has the color col after traveling dist through it, thicker parts get darker.
+func tintedGlass(index float64, col vec3, dist float64) *material {
+	if dist <= 0.0 {
+		panic("tinted glass needs a distance greater than 0")
+	}
+	m := glass(index)
+
+	// Beer-Lambert, col = exp(-absorption * dist).
+	absorb := func(c float64) float64 {
+		return -math.Log(math.Max(c, 1e-6)) / dist
+	}
+	m.absorption = vec(absorb(col.x), absorb(col.y), absorb(col.z))
+
+	return m
+}
+
+// Glass with Cauchy's equation, the wavelength is in micrometers. Crown glass is about 1.5046 and 0.0042.
+func cauchyGlass(a, b, c float64) *material {
+	m := glass(a)
+	m.dispersion = dispersionCauchy
+	m.coeffs = [3]float64{a, b, c}
+	m.refIndex = m.indexAt(589.3)
+
+	return m
+}
+
+// Glass with the Sellmeier equation, the wavelength is in micrometers.
+func sellmeierGlass(b, c [3]float64) *material {
+	m := glass(1.0)
+	m.dispersion = dispersionSellmeier
+	m.coeffs = b
+	m.poles = c
+	m.refIndex = m.indexAt(589.3)
+
+	return m
+}
+
+// Dense flint glass (SF11), it splits light a lot more than window glass, good for prisms.
+func flintGlass() *material {
+	return sellmeierGlass(
+		[3]float64{1.73759695, 0.313747346, 1.89878101},
+		[3]float64{0.013188707, 0.0623068142, 155.23629},
+	)
+}
+
+func diamond() *material {
+	return sellmeierGlass([3]float64{0.3306, 4.3356, 0.0}, [3]float64{0.030625, 0.011236, 0.0})
+}
+
+// The index of the glass at wavelength l in nm. Without dispersion it's the same for all of them,
+// otherwise refIndex is the one at the yellow sodium line, which is the one glass is usually listed with.
+func (m *material) indexAt(l float64) float64 {
+	l = l / 1000.0
+	l2 := l * l
+
+	switch m.dispersion {
+	case dispersionCauchy:
+		return m.coeffs[0] + m.coeffs[1]/l2 + m.coeffs[2]/(l2*l2)
+	case dispersionSellmeier:
+		n2 := 1.0
+		for i := range m.coeffs {
+			n2 += m.coeffs[i] * l2 / (l2 - m.poles[i])
+		}
+		return math.Sqrt(n2)
+	}
+
+	return m.refIndex
+}
+
+func (m *material) scatter(rIn ray, hr *hitRecord, atten *vec3, rOut *ray, rnd sampler) bool {
 	// Difference between diffuse and metallic materials.
 	switch m.matType {
 	case matDiffuse:
 		target := hr.p.add(hr.normal).add(randInUnitSphere(rnd))
-		*rOut = ray{hr.p, target.sub(hr.p), rIn.time}
-		*atten = m.tex.value(hr.u, hr.v, hr.p)
+		*rOut = ray{origin: hr.p, dir: target.sub(hr.p), time: rIn.time}
+		*atten = texValue(m.tex, hr)
 		return true
 
 	case matMetal:
@@ -66,12 +157,21 @@ func (m *material) scatter(rIn ray, hr *hitRecord, atten *vec3, rOut *ray, rnd *
 
 		// For optimization, there is no point in calculating random in unit sphere,
 		// if it's going to be multiplied be 0 anyway. Improvement: 33%	for a material using 0.0 fuzz.
+		// Only perfect mirrors keep the differentials, fuzzy ones blur things anyway.
 		if m.fuzz == 0.0 {
-			*rOut = ray{hr.p, reflected, rIn.time}
+			*rOut = ray{origin: hr.p, dir: reflected, time: rIn.time, diff: reflectDiff(rIn, hr, reflected)}
 		} else {
-			*rOut = ray{hr.p, reflected.add(randInUnitSphere(rnd).subScalar(m.fuzz)), rIn.time}
+			*rOut = ray{origin: hr.p, dir: reflected.add(randInUnitSphere(rnd).subScalar(m.fuzz)), time: rIn.time}
+		}
+		*atten = texValue(m.tex, hr)
+
+		if m.film > 0.0 {
+			cosI := math.Abs(dot(rIn.dir.normalize(), hr.normal))
+			d := m.filmThickness(hr)
+			*atten = filmColor(rIn, *atten, func(l, f0 float64) float64 {
+				return filmOverMetal(cosI, m.filmIndex, f0, d, l)
+			})
 		}
-		*atten = m.tex.value(hr.u, hr.v, hr.p)
 
 		return dot(rOut.dir, hr.normal) > 0.0
 
@@ -85,27 +185,68 @@ func (m *material) scatter(rIn ray, hr *hitRecord, atten *vec3, rOut *ray, rnd *
 		var cosine float64
 		var reflectProbe float64
 
-		if dot(rIn.dir, hr.normal) > 0.0 {
+		index := m.refIndex
+		if m.dispersion != dispersionNone && rIn.wl != nil {
+			// Every wavelength bends its own way now, only the hero can go on.
+			rIn.wl.collapse()
+			index = m.indexAt(rIn.wl.lambda[0])
+		}
+
+		inside := dot(rIn.dir, hr.normal) > 0.0
+		if inside {
 			outwardNormal = hr.normal.mulScalar(-1.0)
-			niOverNt = m.refIndex
-			cosine = m.refIndex * dot(rIn.dir, hr.normal) / rIn.dir.length()
+			niOverNt = index
+			cosine = index * dot(rIn.dir, hr.normal) / rIn.dir.length()
+
+			// We're leaving the glass, so the ray went through it all the way from where it started.
+			dist := hr.t * rIn.dir.length()
+			*atten = vec(
+				math.Exp(-m.absorption.x*dist),
+				math.Exp(-m.absorption.y*dist),
+				math.Exp(-m.absorption.z*dist),
+			)
 		} else {
 			outwardNormal = hr.normal
-			niOverNt = 1.0 / m.refIndex
+			niOverNt = 1.0 / index
 			cosine = -dot(rIn.dir, hr.normal) / rIn.dir.length()
 		}
 
 		if refract(rIn.dir, outwardNormal, niOverNt, &refracted) {
-			reflectProbe = schlick(cosine, m.refIndex)
+			reflectProbe = schlick(cosine, index)
 		} else {
-			*rOut = ray{hr.p, reflected, rIn.time}
+			*rOut = ray{origin: hr.p, dir: reflected, time: rIn.time, diff: reflectDiff(rIn, hr, reflected)}
 			return true
 		}
 
-		if rnd.Float64() < reflectProbe {
-			*rOut = ray{hr.p, reflected, rIn.time}
+		// With a film every color reflects its own amount, pick by the average and make up for it in the color.
+		var reflectColor, refractColor vec3
+		if m.film > 0.0 {
+			n1, n3 := 1.0, index
+			if inside {
+				n1, n3 = index, 1.0
+			}
+			cosI := -dot(rIn.dir.normalize(), outwardNormal)
+			d := m.filmThickness(hr)
+			fr := filmColor(rIn, vec3{}, func(l, f0 float64) float64 {
+				return filmOverDielectric(cosI, n1, m.filmIndex, n3, d, l)
+			})
+
+			// Kept away from 0 and 1, so we never divide by 0 and both ways stay possible.
+			reflectProbe = math.Min(math.Max(gray(fr), 1e-4), 1.0-1e-4)
+			reflectColor = fr.divScalar(reflectProbe)
+			refractColor = vec(1.0, 1.0, 1.0).sub(fr).divScalar(1.0 - reflectProbe)
+		}
+
+		if rnd.get1D() < reflectProbe {
+			*rOut = ray{origin: hr.p, dir: reflected, time: rIn.time, diff: reflectDiff(rIn, hr, reflected)}
+			if m.film > 0.0 {
+				*atten = atten.mul(reflectColor)
+			}
 		} else {
-			*rOut = ray{hr.p, refracted, rIn.time}
+			*rOut = ray{origin: hr.p, dir: refracted, time: rIn.time, diff: refractDiff(rIn, hr, refracted, outwardNormal, niOverNt)}
+			if m.film > 0.0 {
+				*atten = atten.mul(refractColor)
+			}
 		}
 
 		return true
@@ -139,6 +280,19 @@ type texture interface {
 	value(u, v float64, p vec3) vec3
 }
 
+// Textures that want to know more about the hit than the UVs and the point, like how big the pixel is on the surface.
+type hitTexture interface {
+	valueAt(hr *hitRecord) vec3
+}
+
+// Looks up a texture for a hit, with everything it knows about the hit.
+func texValue(t texture, hr *hitRecord) vec3 {
+	if ht, ok := t.(hitTexture); ok {
+		return ht.valueAt(hr)
+	}
+	return t.value(hr.u, hr.v, hr.p)
+}
+
 type solidColor struct {
 	col vec3
 }
@@ -151,175 +305,61 @@ func col(r, g, b float64) texture {
 	return solidColor{vec(r, g, b)}
 }
 
+// Where the checkerboard is laid out.
+const (
+	checkerWorld uint8 = 0 // In the scene, every object cuts through the same 3D pattern.
+	checkerUV    uint8 = 1 // On the UVs of the object, good for seeing how a texture will be stretched.
+)
+
 type checkerTex struct {
 	colOdd, colEven vec3
-}
-
-func checker(col0, col1 vec3) texture {
-	return checkerTex{col0, col1}
-}
-
-func (c checkerTex) value(u, v float64, p vec3) vec3 {
-	sines := math.Sin(10.0*p.x) * math.Sin(10.0*p.y) * math.Sin(10.0*p.z)
-	if sines < 0 {
-		return c.colOdd
-	}
-
-	return c.colEven
-}
-
-type noiseTex struct {
-	noise *perlin
-	scale float64
-}
-
-func perlTex(s float64) *noiseTex {
-	return &noiseTex{per(), s}
-}
-
-func (t *noiseTex) value(u, v float64, p vec3) vec3 {
-	return vec(1.0, 1.0, 1.0).mulScalar(0.5).mulScalar(1.0 + math.Sin(t.scale*p.z+10*t.noise.turb(p)))
-}
+	mode            uint8
 
-// Perlin noise is blurred white noise.
-type perlin struct {
-	permX, permY, permZ [256]int32
-	ranvec              [256]vec3
+	// In world mode scale is how fast the pattern changes, a square is pi / scale wide.
+	// In UV mode they're the number of squares along u and v.
+	scaleU, scaleV float64
 }
 
-func per() *perlin {
-	return &perlin{
-		perlinGenPerm(),
-		perlinGenPerm(),
-		perlinGenPerm(),
-		perlinGen(),
-	}
+func checker(col0, col1 vec3) texture {
+	return scaledChecker(col0, col1, 10.0)
 }
 
-func (p *perlin) noise(perm vec3) float64 {
-	u := perm.x - math.Floor(perm.x)
-	v := perm.y - math.Floor(perm.y)
-	w := perm.z - math.Floor(perm.z)
-
-	i := int(math.Floor(perm.x))
-	j := int(math.Floor(perm.y))
-	k := int(math.Floor(perm.z))
-
-	var c [2][2][2]vec3
-	for di := 0; di < 2; di++ {
-		for dj := 0; dj < 2; dj++ {
-			for dk := 0; dk < 2; dk++ {
-				c[di][dj][dk] = p.ranvec[p.permX[(i+di)&255]^p.permY[(j+dj)&255]^p.permZ[(k+dk)&255]]
-			}
-		}
-	}
-
-	return trilinearInterp(c, u, v, w)
+func scaledChecker(col0, col1 vec3, scale float64) texture {
+	return checkerTex{col0, col1, checkerWorld, scale, scale}
 }
 
-func (p *perlin) turb(perm vec3) float64 {
-	accum := 0.0
-	temp := perm
-	weight := 1.0
-	for i := 0; i < 7; i++ {
-		accum += weight * p.noise(temp)
-		weight *= 0.5
-		temp = temp.mulScalar(2.0)
-	}
-
-	return math.Abs(accum)
+// On a sphere u goes around and v from pole to pole, so twice as many squares along u keeps them square.
+func uvChecker(col0, col1 vec3, squaresU, squaresV float64) texture {
+	return checkerTex{col0, col1, checkerUV, squaresU, squaresV}
 }
 
-func trilinearInterp(c [2][2][2]vec3, u, v, w float64) float64 {
-	uu := u * u * (3.0 - 2.0*u)
-	vv := v * v * (3.0 - 2.0*v)
-	ww := w * w * (3.0 - 2.0*w)
-
-	accum := 0.0
-	for i := 0; i < 2; i++ {
-		for j := 0; j < 2; j++ {
-			for k := 0; k < 2; k++ {
-				weight := vec(u-float64(i), v-float64(j), w-float64(k))
-				accum += (float64(i)*uu + (1.0-float64(i))*(1.0-uu)) *
-					(float64(j)*vv + (1.0-float64(j))*(1.0-vv)) *
-					(float64(k)*ww + (1.0-float64(k))*(1.0-ww)) * dot(c[i][j][k], weight)
-			}
+func (c checkerTex) value(u, v float64, p vec3) vec3 {
+	if c.mode == checkerUV {
+		i := int(math.Floor(u * c.scaleU))
+		j := int(math.Floor(v * c.scaleV))
+		if (i+j)&1 != 0 {
+			return c.colOdd
 		}
+		return c.colEven
 	}
 
-	return accum
-}
-
-func permute(p *[256]int32, n int32) {
-	for i := n - 1; i > 0; i-- {
-		target := int32(rand.Float64() * float64(i+1))
-		tmp := p[i]
-		p[i] = p[target]
-		p[target] = tmp
-	}
-}
-
-func perlinGenPerm() [256]int32 {
-	var p [256]int32
-	for i := 0; i < 256; i++ {
-		p[i] = int32(i)
-	}
-	permute(&p, 256)
-	return p
-}
-
-// Generate the perlin noise.
-func perlinGen() [256]vec3 {
-	var p [256]vec3
-
-	for i := 0; i < 256; i++ {
-		p[i] = vec(-1.0+2.0*rand.Float64(), -1.0+2.0*rand.Float64(), -1.0+2.0*rand.Float64()).normalize()
+	sines := math.Sin(c.scaleU*p.x) * math.Sin(c.scaleU*p.y) * math.Sin(c.scaleU*p.z)
+	if sines < 0 {
+		return c.colOdd
 	}
 
-	return p
+	return c.colEven
 }
 
-type imageTex struct {
-	nx, ny int
-	data   *image.RGBA
+type noiseTex struct {
+	noise noiseGen
+	scale float64
 }
 
-func createImageTex(name string) *imageTex {
-	name, err := filepath.Abs(name)
-	check(err)
-
-	file, err := os.Open(name)
-	check(err)
-	defer file.Close()
-
-	img, _, err := image.Decode(file)
-	check(err)
-	data := image.NewRGBA(img.Bounds())
-	draw.Draw(data, data.Bounds(), img, image.Point{0, 0}, draw.Src)
-
-	return &imageTex{data.Rect.Size().X, data.Rect.Size().Y, data}
+func perlTex(s float64, n noiseGen) *noiseTex {
+	return &noiseTex{n, s}
 }
 
-func (t *imageTex) value(u, v float64, p vec3) vec3 {
-	i := int(u * float64(t.nx))
-	j := int((1.0-v)*float64(t.ny) - 0.001)
-	if i < 0 {
-		i = 0
-	}
-	if j < 0 {
-		j = 0
-	}
-	if i > t.nx-1 {
-		i = t.nx - 1
-	}
-	if j > t.ny-1 {
-		j = t.ny - 1
-	}
-
-	col := t.data.RGBAAt(i, j)
-
-	r := float64(col.R) / 255.0
-	g := float64(col.G) / 255.0
-	b := float64(col.B) / 255.0
-	return vec(r, g, b)
+func (t *noiseTex) value(u, v float64, p vec3) vec3 {
+	return vec(1.0, 1.0, 1.0).mulScalar(0.5).mulScalar(1.0 + math.Sin(t.scale*p.z+10*turb(t.noise, p)))
 }
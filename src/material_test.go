@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUVChecker(t *testing.T) {
+	odd, even := vec(1.0, 0.0, 0.0), vec(0.0, 0.0, 1.0)
+	c := uvChecker(odd, even, 8.0, 4.0)
+
+	for i := -8; i < 16; i++ {
+		for j := -4; j < 8; j++ {
+			// The middle of square i, j.
+			u := (float64(i) + 0.5) / 8.0
+			v := (float64(j) + 0.5) / 4.0
+
+			want := even
+			if (i+j)%2 != 0 {
+				want = odd
+			}
+			if got := c.value(u, v, vec3{}); got != want {
+				t.Fatalf("square %d, %d is %v, want %v", i, j, got, want)
+			}
+		}
+	}
+}
+
+func TestScaledChecker(t *testing.T) {
+	odd, even := vec(1.0, 0.0, 0.0), vec(0.0, 0.0, 1.0)
+	def := checker(odd, even)
+	same := scaledChecker(odd, even, 10.0)
+	big := scaledChecker(odd, even, 5.0)
+
+	for i := 0; i < 200; i++ {
+		p := vec(float64(i)*0.0173+0.01, float64(i)*0.0311+0.02, float64(i)*0.0071+0.03)
+		if def.value(0.0, 0.0, p) != same.value(0.0, 0.0, p) {
+			t.Fatalf("the default checker isn't scale 10 at %v", p)
+		}
+		// Half the scale is twice as big.
+		if big.value(0.0, 0.0, p) != same.value(0.0, 0.0, p.mulScalar(0.5)) {
+			t.Fatalf("scale 5 at %v isn't scale 10 at half of it", p)
+		}
+	}
+}
+
+func TestTintedGlass(t *testing.T) {
+	m := tintedGlass(1.5, vec(0.6, 0.85, 0.7), 0.4)
+
+	// After dist the light has the color, after twice that it's the color squared.
+	for _, d := range []float64{0.4, 0.8} {
+		want := vec(math.Pow(0.6, d/0.4), math.Pow(0.85, d/0.4), math.Pow(0.7, d/0.4))
+		got := vec(math.Exp(-m.absorption.x*d), math.Exp(-m.absorption.y*d), math.Exp(-m.absorption.z*d))
+		if !vecNear(got, want) {
+			t.Errorf("after %v the color is %v, want %v", d, got, want)
+		}
+	}
+
+	// A ray leaving the glass after going through 0.4 of it takes the color along, whichever way it goes on.
+	rnd := newSampler(smpIndependent, 1, 1, 0)
+	r := ray{origin: vec(0.0, 0.0, -0.4), dir: vec(0.0, 0.0, 1.0)}
+	for i := 0; i < 20; i++ {
+		hr := flatHit(0.0, 0.0)
+		hr.t = 0.4
+		var atten vec3
+		var out ray
+		if !m.scatter(r, &hr, &atten, &out, rnd) || !vecNear(atten, vec(0.6, 0.85, 0.7)) {
+			t.Fatalf("leaving the glass the color is %v", atten)
+		}
+	}
+
+	for _, d := range []float64{0.0, -1.0} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("tinted glass with distance %v should be rejected", d)
+				}
+			}()
+			tintedGlass(1.5, vec(0.6, 0.85, 0.7), d)
+		}()
+	}
+}
+
+// A film only splits the light between the two ways, so on average all of it goes on. Even when it reflects all of it.
+func TestFilmGlassKeepsLight(t *testing.T) {
+	rnd := newSampler(smpIndependent, 1, 1, 0)
+
+	for _, m := range []*material{soapBubble(400.0), glass(1.5).filmCoated(300.0, 1.33)} {
+		for _, cos := range []float64{1.0, 0.5, 0.1, 1e-6, 0.0} {
+			r := ray{origin: vec(0.0, 0.0, 1.0), dir: vec(math.Sqrt(1.0-cos*cos), 0.0, -cos)}
+			hr := flatHit(0.0, 0.0)
+
+			n := 20000
+			sum := vec3{}
+			for i := 0; i < n; i++ {
+				var atten vec3
+				var out ray
+				m.scatter(r, &hr, &atten, &out, rnd)
+				for k := 0; k < 3; k++ {
+					if c := atten.get(k); math.IsNaN(c) || math.IsInf(c, 0) || c < 0.0 {
+						t.Fatalf("at cosine %v the color is %v", cos, atten)
+					}
+				}
+				sum = sum.add(atten)
+			}
+
+			if mean := sum.divScalar(float64(n)); mean.sub(vec(1.0, 1.0, 1.0)).length() > 0.05 {
+				t.Errorf("at cosine %v on average %v goes on, want all of it", cos, mean)
+			}
+		}
+	}
+}
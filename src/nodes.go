@@ -0,0 +1,230 @@
+package main
+
+import (
+	"math"
+)
+
+// Textures made out of other textures, so new looks can be put together in the scene instead of
+// needing a new type every time. They all pass the whole hit on, so image textures inside still get filtered.
+
+// The average of the color, for textures used as a factor or a mask.
+func gray(c vec3) float64 {
+	return (c.x + c.y + c.z) / 3.0
+}
+
+// Looks up a hit texture when all we have are the UVs and the point.
+func hitValue(t hitTexture, u, v float64, p vec3) vec3 {
+	return t.valueAt(&hitRecord{u: u, v: v, p: p})
+}
+
+// Blends from a to b, where factor is white it's all b.
+type mixTex struct {
+	a, b, factor texture
+}
+
+func mix(a, b, factor texture) texture {
+	return &mixTex{a, b, factor}
+}
+
+func (t *mixTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *mixTex) valueAt(hr *hitRecord) vec3 {
+	f := gray(texValue(t.factor, hr))
+	return lerpVec(texValue(t.a, hr), texValue(t.b, hr), f)
+}
+
+type multiplyTex struct {
+	a, b texture
+}
+
+func multiply(a, b texture) texture {
+	return &multiplyTex{a, b}
+}
+
+func (t *multiplyTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *multiplyTex) valueAt(hr *hitRecord) vec3 {
+	return texValue(t.a, hr).mul(texValue(t.b, hr))
+}
+
+type plusTex struct {
+	a, b texture
+}
+
+func plus(a, b texture) texture {
+	return &plusTex{a, b}
+}
+
+func (t *plusTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *plusTex) valueAt(hr *hitRecord) vec3 {
+	return texValue(t.a, hr).add(texValue(t.b, hr))
+}
+
+// One minus the color, black becomes white.
+type invertTex struct {
+	tex texture
+}
+
+func invert(tex texture) texture {
+	return &invertTex{tex}
+}
+
+func (t *invertTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *invertTex) valueAt(hr *hitRecord) vec3 {
+	c := texValue(t.tex, hr)
+	return vec(1.0-c.x, 1.0-c.y, 1.0-c.z)
+}
+
+// Stretches the range inMin to inMax to outMin to outMax, for every channel. Values outside are clamped.
+type remapTex struct {
+	tex                          texture
+	inMin, inMax, outMin, outMax float64
+}
+
+func remap(tex texture, inMin, inMax, outMin, outMax float64) texture {
+	return &remapTex{tex, inMin, inMax, outMin, outMax}
+}
+
+func (t *remapTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *remapTex) valueAt(hr *hitRecord) vec3 {
+	c := texValue(t.tex, hr)
+	f := func(x float64) float64 {
+		x = math.Max(0.0, math.Min(1.0, (x-t.inMin)/(t.inMax-t.inMin)))
+		return t.outMin + x*(t.outMax-t.outMin)
+	}
+	return vec(f(c.x), f(c.y), f(c.z))
+}
+
+// Turns the gray of a texture into colors with a ramp.
+type colorizeTex struct {
+	tex  texture
+	ramp *colorRamp
+}
+
+func colorize(tex texture, r *colorRamp) texture {
+	return &colorizeTex{tex, r}
+}
+
+func (t *colorizeTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *colorizeTex) valueAt(hr *hitRecord) vec3 {
+	return t.ramp.at(gray(texValue(t.tex, hr)))
+}
+
+// Moves, scales and rotates the UVs of any texture, like uvTransform does for image textures.
+type uvTex struct {
+	tex              texture
+	offsetU, offsetV float64
+	scaleU, scaleV   float64
+	rotation         float64
+}
+
+func uvMapped(tex texture, offsetU, offsetV, scaleU, scaleV, deg float64) texture {
+	return &uvTex{tex, offsetU, offsetV, scaleU, scaleV, deg * math.Pi / 180.0}
+}
+
+func (t *uvTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *uvTex) valueAt(hr *hitRecord) vec3 {
+	sin, cos := math.Sincos(t.rotation)
+	xf := func(u, v float64) (float64, float64) {
+		return (cos*u - sin*v) * t.scaleU, (sin*u + cos*v) * t.scaleV
+	}
+
+	moved := *hr
+	moved.u, moved.v = xf(hr.u, hr.v)
+	moved.u += t.offsetU
+	moved.v += t.offsetV
+	moved.dudx, moved.dvdx = xf(hr.dudx, hr.dvdx)
+	moved.dudy, moved.dvdy = xf(hr.dudy, hr.dvdy)
+
+	return texValue(t.tex, &moved)
+}
+
+// Projects a texture on the surface from the three axes and blends them by the normal,
+// for things without (good) UVs. Higher sharpness makes the seams between the sides shorter.
+type triplanarTex struct {
+	tex       texture
+	scale     float64
+	sharpness float64
+}
+
+func triplanar(tex texture, scale, sharpness float64) texture {
+	return &triplanarTex{tex, scale, sharpness}
+}
+
+// Without a normal there's nothing to blend with, so this looks from above.
+func (t *triplanarTex) value(u, v float64, p vec3) vec3 {
+	return t.valueAt(&hitRecord{u: u, v: v, p: p, normal: vec(0.0, 1.0, 0.0)})
+}
+
+func (t *triplanarTex) valueAt(hr *hitRecord) vec3 {
+	n := hr.normal
+	wx := math.Pow(math.Abs(n.x), t.sharpness)
+	wy := math.Pow(math.Abs(n.y), t.sharpness)
+	wz := math.Pow(math.Abs(n.z), t.sharpness)
+	total := wx + wy + wz
+	if total == 0.0 {
+		return vec3{}
+	}
+
+	p := hr.p.mulScalar(t.scale)
+	side := func(u, v float64, dpdx, dpdy [2]float64) vec3 {
+		proj := *hr
+		proj.u, proj.v = u, v
+		proj.dudx, proj.dvdx = dpdx[0]*t.scale, dpdx[1]*t.scale
+		proj.dudy, proj.dvdy = dpdy[0]*t.scale, dpdy[1]*t.scale
+		return texValue(t.tex, &proj)
+	}
+
+	col := vec3{}
+	if wx > 0.0 {
+		col = col.add(side(p.z, p.y, [2]float64{hr.dpdx.z, hr.dpdx.y}, [2]float64{hr.dpdy.z, hr.dpdy.y}).mulScalar(wx))
+	}
+	if wy > 0.0 {
+		col = col.add(side(p.x, p.z, [2]float64{hr.dpdx.x, hr.dpdx.z}, [2]float64{hr.dpdy.x, hr.dpdy.z}).mulScalar(wy))
+	}
+	if wz > 0.0 {
+		col = col.add(side(p.x, p.y, [2]float64{hr.dpdx.x, hr.dpdx.y}, [2]float64{hr.dpdy.x, hr.dpdy.y}).mulScalar(wz))
+	}
+
+	return col.divScalar(total)
+}
+
+// Darkens a texture with noise, amount 0 leaves it alone and 1 can make it black. Breaks up repeating textures.
+type noiseScaleTex struct {
+	tex    texture
+	noise  noiseGen
+	scale  float64
+	amount float64
+}
+
+func noiseScaled(tex texture, noise noiseGen, scale, amount float64) texture {
+	return &noiseScaleTex{tex, noise, scale, amount}
+}
+
+func (t *noiseScaleTex) value(u, v float64, p vec3) vec3 {
+	return hitValue(t, u, v, p)
+}
+
+func (t *noiseScaleTex) valueAt(hr *hitRecord) vec3 {
+	n := 0.5 + 0.5*t.noise.noise(hr.p.mulScalar(t.scale))
+	return texValue(t.tex, hr).mulScalar(1.0 - t.amount*(1.0-n))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Shows the UVs as red and green.
+type uvColor struct{}
+
+func (uvColor) value(u, v float64, p vec3) vec3 {
+	return vec(u, v, 0.0)
+}
+
+func TestNodeMath(t *testing.T) {
+	a := col(0.2, 0.4, 0.6)
+	b := col(0.5, 0.5, 1.0)
+	p := vec(1.0, 2.0, 3.0)
+
+	cases := []struct {
+		name string
+		tex  texture
+		want vec3
+	}{
+		{"mix black", mix(a, b, col(0.0, 0.0, 0.0)), vec(0.2, 0.4, 0.6)},
+		{"mix white", mix(a, b, col(1.0, 1.0, 1.0)), vec(0.5, 0.5, 1.0)},
+		{"mix half", mix(a, b, col(0.2, 0.5, 0.8)), vec(0.35, 0.45, 0.8)},
+		{"multiply", multiply(a, b), vec(0.1, 0.2, 0.6)},
+		{"plus", plus(a, b), vec(0.7, 0.9, 1.6)},
+		{"invert", invert(a), vec(0.8, 0.6, 0.4)},
+		{"remap", remap(a, 0.2, 0.6, 1.0, 3.0), vec(1.0, 2.0, 3.0)},
+		{"remap clamps", remap(b, 0.0, 0.5, 0.0, 1.0), vec(1.0, 1.0, 1.0)},
+		{"colorize", colorize(a, ramp(stop(0.0, vec(0.0, 0.0, 0.0)), stop(1.0, vec(1.0, 0.0, 2.0)))), vec(0.4, 0.0, 0.8)},
+		{"nested", invert(multiply(a, plus(b, b))), vec(0.8, 0.6, -0.2)},
+	}
+
+	for _, c := range cases {
+		if got := c.tex.value(0.3, 0.7, p); !vecNear(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUVMapped(t *testing.T) {
+	hr := flatHit(0.25, 0.5)
+	hr.dudx, hr.dvdy = 0.01, 0.02
+
+	if got := texValue(uvMapped(uvColor{}, 0.1, 0.2, 2.0, 4.0, 0.0), &hr); !vecNear(got, vec(0.6, 2.2, 0.0)) {
+		t.Errorf("moved and scaled UVs are %v", got)
+	}
+
+	// A quarter turn, u becomes -v and v becomes u.
+	if got := texValue(uvMapped(uvColor{}, 0.0, 0.0, 1.0, 1.0, 90.0), &hr); !vecNear(got, vec(-0.5, 0.25, 0.0)) {
+		t.Errorf("rotated UVs are %v", got)
+	}
+}
+
+func TestTriplanar(t *testing.T) {
+	hr := hitRecord{p: vec(1.0, 2.0, 3.0), normal: vec(0.0, 1.0, 0.0)}
+	tex := triplanar(uvColor{}, 0.5, 4.0)
+
+	// From above it's projected along y.
+	if got := texValue(tex, &hr); !vecNear(got, vec(0.5, 1.5, 0.0)) {
+		t.Errorf("seen from above: %v", got)
+	}
+
+	// From the side it's projected along x.
+	hr.normal = vec(-1.0, 0.0, 0.0)
+	if got := texValue(tex, &hr); !vecNear(got, vec(1.5, 1.0, 0.0)) {
+		t.Errorf("seen from the side: %v", got)
+	}
+
+	// In between both sides count the same.
+	hr.normal = vec(1.0, 1.0, 0.0).normalize()
+	if got := texValue(tex, &hr); !vecNear(got, vec(1.0, 1.25, 0.0)) {
+		t.Errorf("seen from in between: %v", got)
+	}
+}
+
+func TestNoiseScaled(t *testing.T) {
+	n := noiseFor(noiseSimplex, 3)
+	tex := col(0.8, 0.6, 0.4)
+
+	untouched := noiseScaled(tex, n, 2.0, 0.0)
+	darkened := noiseScaled(tex, n, 2.0, 1.0)
+	for i := 0; i < 200; i++ {
+		p := vec(float64(i)*0.19, float64(i)*0.07, 0.3)
+		if got := untouched.value(0.0, 0.0, p); !vecNear(got, vec(0.8, 0.6, 0.4)) {
+			t.Fatalf("amount 0 changed the color to %v", got)
+		}
+
+		got := darkened.value(0.0, 0.0, p)
+		f := got.x / 0.8
+		if f < -1e-9 || f > 1.0+1e-9 || math.Abs(got.y-0.6*f) > 1e-9 || math.Abs(got.z-0.4*f) > 1e-9 {
+			t.Fatalf("at %v the color is %v, it should only get darker", p, got)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// Smooth random values that change gradually through space, between about -1 and 1.
+type noiseGen interface {
+	noise(p vec3) float64
+}
+
+// Kinds of noise for noiseFor.
+const (
+	noiseClassic  uint8 = 0 // The original Perlin noise with random gradients, it has some grid artifacts.
+	noiseImproved uint8 = 1 // Perlin's improved noise, smoother and without the artifacts.
+	noiseSimplex  uint8 = 2 // Simplex noise, faster and it doesn't look like a grid at all.
+)
+
+type noiseKey struct {
+	kind uint8
+	seed int64
+}
+
+var (
+	noiseMu    sync.Mutex
+	noiseCache = map[noiseKey]noiseGen{}
+)
+
+// The noise of a kind for a seed, every texture that asks for the same one shares its tables.
+func noiseFor(kind uint8, seed int64) noiseGen {
+	noiseMu.Lock()
+	defer noiseMu.Unlock()
+
+	k := noiseKey{kind, seed}
+	if n, ok := noiseCache[k]; ok {
+		return n
+	}
+
+	rnd := rand.New(rand.NewSource(seed))
+	var n noiseGen
+	switch kind {
+	case noiseImproved:
+		n = improvedPerlin(rnd)
+	case noiseSimplex:
+		n = simplex(rnd)
+	default:
+		n = per(rnd)
+	}
+
+	noiseCache[k] = n
+	return n
+}
+
+// The marble of the original scene, the absolute value of 7 octaves.
+func turb(n noiseGen, p vec3) float64 {
+	return math.Abs(fbm(n, p, fractal(7, 2.0, 0.5)))
+}
+
+// Fractal noise, adds octaves of noise that are lacunarity times smaller and gain times weaker every time.
+func fbm(n noiseGen, p vec3, frac fractalParams) float64 {
+	accum := 0.0
+	temp := p
+	weight := 1.0
+	for i := 0; i < frac.octaves; i++ {
+		accum += weight * n.noise(temp)
+		weight *= frac.gain
+		temp = temp.mulScalar(frac.lacunarity)
+	}
+
+	return accum
+}
+
+// Like fbm, but with the absolute value of every octave, so it has creases where the noise crosses zero.
+func turbulence(n noiseGen, p vec3, frac fractalParams) float64 {
+	accum := 0.0
+	temp := p
+	weight := 1.0
+	for i := 0; i < frac.octaves; i++ {
+		accum += weight * math.Abs(n.noise(temp))
+		weight *= frac.gain
+		temp = temp.mulScalar(frac.lacunarity)
+	}
+
+	return accum
+}
+
+// Sharp ridges where the noise crosses zero, good for mountains and veins. Goes from 0 to 1.
+func ridged(n noiseGen, p vec3, frac fractalParams) float64 {
+	accum := 0.0
+	total := 0.0
+	temp := p
+	weight := 1.0
+	for i := 0; i < frac.octaves; i++ {
+		r := 1.0 - math.Abs(n.noise(temp))
+		accum += weight * r * r
+		total += weight
+		weight *= frac.gain
+		temp = temp.mulScalar(frac.lacunarity)
+	}
+
+	if total == 0.0 {
+		return 0.0
+	}
+	return accum / total
+}
+
+// Perlin noise is blurred white noise.
+type perlin struct {
+	permX, permY, permZ [256]int32
+	ranvec              [256]vec3
+}
+
+// The tables are filled using rnd, so the same seed gives the same noise.
+func per(rnd *rand.Rand) *perlin {
+	return &perlin{
+		perlinGenPerm(rnd),
+		perlinGenPerm(rnd),
+		perlinGenPerm(rnd),
+		perlinGen(rnd),
+	}
+}
+
+func (p *perlin) noise(perm vec3) float64 {
+	u := perm.x - math.Floor(perm.x)
+	v := perm.y - math.Floor(perm.y)
+	w := perm.z - math.Floor(perm.z)
+
+	i := int(math.Floor(perm.x))
+	j := int(math.Floor(perm.y))
+	k := int(math.Floor(perm.z))
+
+	var c [2][2][2]vec3
+	for di := 0; di < 2; di++ {
+		for dj := 0; dj < 2; dj++ {
+			for dk := 0; dk < 2; dk++ {
+				c[di][dj][dk] = p.ranvec[p.permX[(i+di)&255]^p.permY[(j+dj)&255]^p.permZ[(k+dk)&255]]
+			}
+		}
+	}
+
+	return trilinearInterp(c, u, v, w)
+}
+
+func trilinearInterp(c [2][2][2]vec3, u, v, w float64) float64 {
+	uu := u * u * (3.0 - 2.0*u)
+	vv := v * v * (3.0 - 2.0*v)
+	ww := w * w * (3.0 - 2.0*w)
+
+	accum := 0.0
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			for k := 0; k < 2; k++ {
+				weight := vec(u-float64(i), v-float64(j), w-float64(k))
+				accum += (float64(i)*uu + (1.0-float64(i))*(1.0-uu)) *
+					(float64(j)*vv + (1.0-float64(j))*(1.0-vv)) *
+					(float64(k)*ww + (1.0-float64(k))*(1.0-ww)) * dot(c[i][j][k], weight)
+			}
+		}
+	}
+
+	return accum
+}
+
+func permute(p *[256]int32, n int32, rnd *rand.Rand) {
+	for i := n - 1; i > 0; i-- {
+		target := int32(rnd.Float64() * float64(i+1))
+		tmp := p[i]
+		p[i] = p[target]
+		p[target] = tmp
+	}
+}
+
+func perlinGenPerm(rnd *rand.Rand) [256]int32 {
+	var p [256]int32
+	for i := 0; i < 256; i++ {
+		p[i] = int32(i)
+	}
+	permute(&p, 256, rnd)
+	return p
+}
+
+// Generate the perlin noise.
+func perlinGen(rnd *rand.Rand) [256]vec3 {
+	var p [256]vec3
+
+	for i := 0; i < 256; i++ {
+		p[i] = vec(-1.0+2.0*rnd.Float64(), -1.0+2.0*rnd.Float64(), -1.0+2.0*rnd.Float64()).normalize()
+	}
+
+	return p
+}
+
+// A shuffled table of 0 to 255, twice, so we don't have to wrap the indices.
+func doublePerm(rnd *rand.Rand) [512]int32 {
+	p := perlinGenPerm(rnd)
+	var d [512]int32
+	for i := 0; i < 512; i++ {
+		d[i] = p[i&255]
+	}
+	return d
+}
+
+// Perlin's improved noise from 2002. The gradients point to the edges of a cube, which hides the grid,
+// and the smoother fade curve gets rid of the creases the classic noise has between the cells.
+type improvedNoise struct {
+	perm [512]int32
+}
+
+func improvedPerlin(rnd *rand.Rand) *improvedNoise {
+	return &improvedNoise{doublePerm(rnd)}
+}
+
+func (n *improvedNoise) noise(p vec3) float64 {
+	fx, fy, fz := math.Floor(p.x), math.Floor(p.y), math.Floor(p.z)
+	i, j, k := int(fx)&255, int(fy)&255, int(fz)&255
+	x, y, z := p.x-fx, p.y-fy, p.z-fz
+	u, v, w := fade(x), fade(y), fade(z)
+
+	perm := &n.perm
+	a := perm[i] + int32(j)
+	aa := perm[a] + int32(k)
+	ab := perm[a+1] + int32(k)
+	b := perm[i+1] + int32(j)
+	ba := perm[b] + int32(k)
+	bb := perm[b+1] + int32(k)
+
+	return lerp(
+		lerp(
+			lerp(grad(perm[aa], x, y, z), grad(perm[ba], x-1.0, y, z), u),
+			lerp(grad(perm[ab], x, y-1.0, z), grad(perm[bb], x-1.0, y-1.0, z), u),
+			v),
+		lerp(
+			lerp(grad(perm[aa+1], x, y, z-1.0), grad(perm[ba+1], x-1.0, y, z-1.0), u),
+			lerp(grad(perm[ab+1], x, y-1.0, z-1.0), grad(perm[bb+1], x-1.0, y-1.0, z-1.0), u),
+			v),
+		w)
+}
+
+// 6t^5 - 15t^4 + 10t^3, its first and second derivatives are zero at 0 and 1.
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6.0-15.0) + 10.0)
+}
+
+// Dot product of x, y, z with one of the 12 directions to the edges of a cube, picked by the hash.
+func grad(hash int32, x, y, z float64) float64 {
+	h := hash & 15
+	u := y
+	if h < 8 {
+		u = x
+	}
+	v := z
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
+
+// Simplex noise works on a grid of tetrahedrons instead of cubes, so every point only needs four corners.
+type simplexNoise struct {
+	perm [512]int32
+}
+
+func simplex(rnd *rand.Rand) *simplexNoise {
+	return &simplexNoise{doublePerm(rnd)}
+}
+
+var simplexGrad = [12]vec3{
+	{1, 1, 0}, {-1, 1, 0}, {1, -1, 0}, {-1, -1, 0},
+	{1, 0, 1}, {-1, 0, 1}, {1, 0, -1}, {-1, 0, -1},
+	{0, 1, 1}, {0, -1, 1}, {0, 1, -1}, {0, -1, -1},
+}
+
+func (n *simplexNoise) noise(p vec3) float64 {
+	const f3 = 1.0 / 3.0
+	const g3 = 1.0 / 6.0
+
+	// Skew the space to find the cube of tetrahedrons we're in.
+	s := (p.x + p.y + p.z) * f3
+	fi, fj, fk := math.Floor(p.x+s), math.Floor(p.y+s), math.Floor(p.z+s)
+	t := (fi + fj + fk) * g3
+	x0 := vec(p.x-(fi-t), p.y-(fj-t), p.z-(fk-t))
+
+	// Which of the six tetrahedrons, by the order of the coordinates.
+	var o1, o2 vec3
+	if x0.x >= x0.y {
+		if x0.y >= x0.z {
+			o1, o2 = vec(1, 0, 0), vec(1, 1, 0)
+		} else if x0.x >= x0.z {
+			o1, o2 = vec(1, 0, 0), vec(1, 0, 1)
+		} else {
+			o1, o2 = vec(0, 0, 1), vec(1, 0, 1)
+		}
+	} else {
+		if x0.y < x0.z {
+			o1, o2 = vec(0, 0, 1), vec(0, 1, 1)
+		} else if x0.x < x0.z {
+			o1, o2 = vec(0, 1, 0), vec(0, 1, 1)
+		} else {
+			o1, o2 = vec(0, 1, 0), vec(1, 1, 0)
+		}
+	}
+
+	corners := [4]vec3{
+		x0,
+		x0.sub(o1).addScalar(g3),
+		x0.sub(o2).addScalar(2.0 * g3),
+		x0.subScalar(1.0 - 3.0*g3),
+	}
+	offsets := [4]vec3{{}, o1, o2, vec(1, 1, 1)}
+
+	i, j, k := int32(int(fi)&255), int32(int(fj)&255), int32(int(fk)&255)
+	perm := &n.perm
+
+	total := 0.0
+	for c := 0; c < 4; c++ {
+		d := corners[c]
+		// Every corner only reaches a little further than the middle of the tetrahedron, so there are no seams.
+		falloff := 0.5 - d.lengthSqr()
+		if falloff <= 0.0 {
+			continue
+		}
+
+		o := offsets[c]
+		h := perm[i+int32(o.x)+perm[j+int32(o.y)+perm[k+int32(o.z)]]] % 12
+		falloff *= falloff
+		total += falloff * falloff * dot(simplexGrad[h], d)
+	}
+
+	// Scales the result to about -1 to 1.
+	return 70.0 * total
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestNoiseRange(t *testing.T) {
+	for _, kind := range []uint8{noiseClassic, noiseImproved, noiseSimplex} {
+		n := noiseFor(kind, 5)
+		lo, hi := 0.0, 0.0
+		for i := 0; i < 20000; i++ {
+			p := vec(float64(i)*0.0731, float64(i%97)*0.191, float64(i%89)*-0.277)
+			v := n.noise(p)
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+
+		if lo < -1.1 || hi > 1.1 {
+			t.Errorf("noise %d goes from %v to %v, want about -1 to 1", kind, lo, hi)
+		}
+		if hi-lo < 0.5 {
+			t.Errorf("noise %d only goes from %v to %v, it's too flat", kind, lo, hi)
+		}
+	}
+}
+
+// The tables have 256 entries, so the noise repeats every 256 units.
+func TestNoisePeriod(t *testing.T) {
+	shifts := map[uint8]vec3{
+		noiseClassic:  vec(256.0, 0.0, 0.0),
+		noiseImproved: vec(0.0, 256.0, 0.0),
+		// Simplex works on a skewed grid, it only repeats along the diagonal.
+		noiseSimplex: vec(256.0, 256.0, 256.0),
+	}
+
+	for kind, shift := range shifts {
+		n := noiseFor(kind, 5)
+		for i := 0; i < 100; i++ {
+			p := vec(float64(i)*0.37, float64(i)*0.11, 0.5)
+			if a, b := n.noise(p), n.noise(p.add(shift)); math.Abs(a-b) > 1e-6 {
+				t.Errorf("noise %d at %v is %v, but %v one period further", kind, p, a, b)
+			}
+		}
+	}
+}
+
+func TestNoiseShared(t *testing.T) {
+	if noiseFor(noiseImproved, 9) != noiseFor(noiseImproved, 9) {
+		t.Error("the same kind and seed should share the noise")
+	}
+	if noiseFor(noiseImproved, 9) == noiseFor(noiseImproved, 10) || noiseFor(noiseImproved, 9) == noiseFor(noiseSimplex, 9) {
+		t.Error("another kind or seed should get its own noise")
+	}
+
+	// The same seed gives the same noise, even if it had to be made again.
+	p := vec(1.3, 2.7, -0.4)
+	if per(rand.New(rand.NewSource(4))).noise(p) != noiseFor(noiseClassic, 4).noise(p) {
+		t.Error("the noise isn't made from the seed")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"math"
+	"sort"
 )
 
 type hitRecord struct {
@@ -9,11 +10,21 @@ type hitRecord struct {
 	u, v      float64
 	p, normal vec3
 	mat       *material
+
+	// How the point and the normal change when moving over the surface in u and v.
+	dpdu, dpdv vec3
+	dndu, dndv vec3
+
+	// How much the point and the UVs change to the next pixel, they're zero when we don't know.
+	dpdx, dpdy vec3
+	dudx, dvdx float64
+	dudy, dvdy float64
 }
 
 // Use these to differentiate the different shapes of objects.
 const (
-	shapeCircle uint8 = 0
+	shapeCircle   uint8 = 0
+	shapeInstance uint8 = 1
 )
 
 // Objects can be hit by rays.
@@ -23,20 +34,34 @@ type object struct {
 	center0, center1 vec3
 	time0, time1     float64
 	mat              *material
+
+	// Instances are another object, moved by a transform that can change over time.
+	inst   *object
+	motion motion
 }
 
 func sphere(radius float64, center vec3, mat *material) *object {
 	return &object{
-		shapeCircle, radius, center, center, 0.0, 1.0, mat,
+		shape: shapeCircle, radius: radius, center0: center, center1: center, time0: 0.0, time1: 1.0, mat: mat,
 	}
 }
 
 func movingSphere(radius float64, center0, center1 vec3, time0, time1 float64, mat *material) *object {
 	return &object{
-		shapeCircle, radius, center0, center1, time0, time1, mat,
+		shape: shapeCircle, radius: radius, center0: center0, center1: center1, time0: time0, time1: time1, mat: mat,
 	}
 }
 
+// Places obj in the scene with a transform, with more than one key it moves between them.
+// Translation and scale are interpolated linearly, rotations with slerp.
+func instance(obj *object, keys ...transformKey) *object {
+	if len(keys) == 0 {
+		keys = []transformKey{key(0.0, vec(0.0, 0.0, 0.0), vec(0.0, 1.0, 0.0), 0.0, vec(1.0, 1.0, 1.0))}
+	}
+
+	return &object{shape: shapeInstance, inst: obj, motion: newMotion(keys)}
+}
+
 func (o *object) hit(r ray, tmin float64, tmax float64, hr *hitRecord) bool {
 	// Different implementations for different shapes.
 	switch o.shape {
@@ -51,28 +76,35 @@ func (o *object) hit(r ray, tmin float64, tmax float64, hr *hitRecord) bool {
 		// Use the ABC formula to figure out if we're hitting the sphere.
 		discriminant := b*b - a*c
 		if discriminant > 0.0 {
+			// The hit goes into its own record first, a cut out part can't touch the closest hit so far.
+			center := o.center(r.time)
+			try := func(temp float64) bool {
+				if temp <= tmin || temp >= tmax {
+					return false
+				}
+
+				rec := hitRecord{t: temp, mat: o.mat}
+				rec.p = r.point(rec.t)
+				rec.normal = rec.p.sub(center).divScalar(o.radius)
+				rec.u, rec.v = o.uv(rec.normal)
+				o.derivatives(&rec, center)
+
+				// Rays go through the cut out parts, maybe we hit the other side.
+				if o.mat.transparentAt(r, &rec) {
+					return false
+				}
+				*hr = rec
+				return true
+			}
+
 			// In case I'll ever wonder why we first try the minus variant,
 			// it's because you want the front side of the sphere.
-			temp := (-b - math.Sqrt(discriminant)) / a
-			if temp > tmin && temp < tmax {
-				hr.t = temp
-				hr.p = r.point(hr.t)
-				hr.normal = hr.p.sub(o.center(r.time)).divScalar(o.radius)
-				hr.mat = o.mat
-				hr.u, hr.v = o.uv((hr.p.sub(o.center(r.time))).divScalar(o.radius))
-
+			if try((-b - math.Sqrt(discriminant)) / a) {
 				return true
 			}
 
 			// If there was no solution we now try it with the plus variant.
-			temp = (-b + math.Sqrt(discriminant)) / a
-			if temp > tmin && temp < tmax {
-				hr.t = temp
-				hr.p = r.point(hr.t)
-				hr.normal = hr.p.sub(o.center(r.time)).divScalar(o.radius)
-				hr.mat = o.mat
-				hr.u, hr.v = o.uv((hr.p.sub(o.center(r.time))).divScalar(o.radius))
-
+			if try((-b + math.Sqrt(discriminant)) / a) {
 				return true
 			}
 		}
@@ -80,6 +112,25 @@ func (o *object) hit(r ray, tmin float64, tmax float64, hr *hitRecord) bool {
 		// Return false, because there is no solution.
 		return false
 
+	case shapeInstance:
+		// Move the ray into the space of the object, that's a lot easier than moving the object.
+		// The direction isn't normalized, so the distance t is the same in both spaces.
+		xf := o.motion.at(r.time)
+		local := ray{origin: xf.toLocal(r.origin), dir: xf.dirToLocal(r.dir), time: r.time}
+		if !o.inst.hit(local, tmin, tmax, hr) {
+			return false
+		}
+
+		hr.p = r.point(hr.t)
+		hr.normal = xf.normalToWorld(hr.normal)
+		hr.dpdu = xf.dirToWorld(hr.dpdu)
+		hr.dpdv = xf.dirToWorld(hr.dpdv)
+
+		// The normal derivatives change like normals do, but without normalizing.
+		hr.dndu = xf.rotate.rotate(hr.dndu.div(xf.scale))
+		hr.dndv = xf.rotate.rotate(hr.dndv.div(xf.scale))
+		return true
+
 		// This should never happen, but whatever.
 	default:
 		return false
@@ -100,25 +151,55 @@ func (o *object) uv(p vec3) (float64, float64) {
 	return u, v
 }
 
-// Create the bounding box for an object.
+// The derivatives of the sphere with the UVs from uv. They're along the lines of longitude and latitude.
+func (o *object) derivatives(hr *hitRecord, center vec3) {
+	// The point on the unit sphere, like in uv.
+	q := hr.p.sub(center).divScalar(o.radius)
+
+	// Distance to the axis, it's zero at the poles where u doesn't go anywhere.
+	rho := math.Max(math.Sqrt(q.x*q.x+q.z*q.z), 1e-9)
+
+	hr.dpdu = vec(q.z, 0.0, -q.x).mulScalar(2.0 * math.Pi * o.radius)
+	hr.dpdv = vec(-q.y*q.x/rho, rho, -q.y*q.z/rho).mulScalar(math.Pi * o.radius)
+
+	// The normal is the point divided by the radius, so are its derivatives.
+	hr.dndu = hr.dpdu.divScalar(o.radius)
+	hr.dndv = hr.dpdv.divScalar(o.radius)
+}
+
+// Create the bounding box for an object, it holds everywhere the object goes between t0 and t1.
 func (o *object) boundingBox(t0, t1 float64, box *aabb) bool {
-	// Make the box for the begin and end center.
-	box0 := &aabb{o.center(o.time0).subScalar(o.radius), o.center(o.time0).addScalar(o.radius)}
-	box1 := &aabb{o.center(o.time1).subScalar(o.radius), o.center(o.time1).addScalar(o.radius)}
+	switch o.shape {
+	case shapeCircle:
+		// Make the box for the begin and end center.
+		box0 := &aabb{o.center(t0).subScalar(o.radius), o.center(t0).addScalar(o.radius)}
+		box1 := &aabb{o.center(t1).subScalar(o.radius), o.center(t1).addScalar(o.radius)}
+
+		// Combine the two boxes.
+		*box = *surroundingBox(box0, box1)
+		return true
+
+	case shapeInstance:
+		local := aabb{}
+		if !o.inst.boundingBox(t0, t1, &local) {
+			return false
+		}
+
+		*box = *o.motion.bounds(&local, t0, t1)
+		return true
+	}
 
-	// Combine the two boxes.
-	box = surroundingBox(box0, box1)
-	return true
+	return false
 }
 
 // This is used for moving objects, the bounding box will be the entire path.
 func surroundingBox(b0, b1 *aabb) *aabb {
 	small := vec(ffmin(b0.min.x, b1.min.x),
 		ffmin(b0.min.y, b1.min.y),
-		ffmin(b0.min.z, b0.min.z))
+		ffmin(b0.min.z, b1.min.z))
 	big := vec(ffmax(b0.max.x, b1.max.x),
 		ffmax(b0.max.y, b1.max.y),
-		ffmax(b0.max.z, b0.max.z))
+		ffmax(b0.max.z, b1.max.z))
 	return &aabb{small, big}
 }
 
@@ -126,21 +207,33 @@ type aabb struct {
 	min, max vec3
 }
 
+func (b *aabb) center() vec3 {
+	return b.min.add(b.max).mulScalar(0.5)
+}
+
 func (b *aabb) hit(r ray, tmin, tmax float64) bool {
-	// TODO: Check if this needs to be replaced by the other method given.
-	for a := 0; a < 3; a++ {
-		t0 := ffmin((b.min.get(a)-r.origin.get(a))/r.dir.get(a),
-			(b.max.get(a)-r.origin.get(a))/r.dir.get(a))
-		t1 := ffmax((b.min.get(a)-r.origin.get(a))/r.dir.get(a),
-			(b.max.get(a)-r.origin.get(a))/r.dir.get(a))
-
-		tmin = ffmax(t0, tmin)
-		tmax = ffmin(t1, tmax)
-		if tmax <= tmin {
-			return false
-		}
+	// This is the faster method given by Andrew Kensler, one axis at a time without calling get.
+	return slab(b.min.x, b.max.x, r.origin.x, r.dir.x, &tmin, &tmax) &&
+		slab(b.min.y, b.max.y, r.origin.y, r.dir.y, &tmin, &tmax) &&
+		slab(b.min.z, b.max.z, r.origin.z, r.dir.z, &tmin, &tmax)
+}
+
+// Narrows tmin and tmax down to where the ray is between min and max on one axis.
+func slab(min, max, origin, dir float64, tmin, tmax *float64) bool {
+	invD := 1.0 / dir
+	t0 := (min - origin) * invD
+	t1 := (max - origin) * invD
+	if invD < 0.0 {
+		t0, t1 = t1, t0
+	}
+
+	if t0 > *tmin {
+		*tmin = t0
+	}
+	if t1 < *tmax {
+		*tmax = t1
 	}
-	return true
+	return *tmax > *tmin
 }
 
 // TODO: Do we really need a function for this?
@@ -159,39 +252,91 @@ func ffmax(a, b float64) float64 {
 	return b
 }
 
+// The bounding volume hierarchy is a tree of boxes, when a ray misses a box
+// we can skip everything inside of it.
 type bvhNode struct {
-	left, right object
+	left, right *bvhNode
+	objs        []*object // Only the leaves have objects.
 	box         aabb
 }
 
-// TODO: Finish this system!
-// TODO: Finish this system!
-// TODO: Finish this system!
+// Checking a few objects is quicker than going down more boxes.
+const bvhLeafSize = 4
+
+// Builds the tree, boxes holds the bounding box of every object.
+func newBVH(objects []*object, boxes []aabb) *bvhNode {
+	b := &bvhNode{}
+
+	if len(objects) <= bvhLeafSize {
+		b.objs = objects
+		b.box = boxes[0]
+		for i := 1; i < len(boxes); i++ {
+			b.box = *surroundingBox(&b.box, &boxes[i])
+		}
+		return b
+	}
+
+	// Split along the longest side of the box around all the centers.
+	centers := &aabb{boxes[0].center(), boxes[0].center()}
+	for i := 1; i < len(boxes); i++ {
+		centers = surroundingBox(centers, &aabb{boxes[i].center(), boxes[i].center()})
+	}
+	size := centers.max.sub(centers.min)
+	axis := 0
+	if size.y > size.x && size.y >= size.z {
+		axis = 1
+	} else if size.z > size.x && size.z > size.y {
+		axis = 2
+	}
+
+	// Sort both slices together, so every object keeps its box.
+	order := make([]int, len(objects))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return boxes[order[i]].center().get(axis) < boxes[order[j]].center().get(axis)
+	})
+	sortedObjs := make([]*object, len(objects))
+	sortedBoxes := make([]aabb, len(boxes))
+	for i, o := range order {
+		sortedObjs[i] = objects[o]
+		sortedBoxes[i] = boxes[o]
+	}
+
+	half := len(objects) / 2
+	b.left = newBVH(sortedObjs[:half], sortedBoxes[:half])
+	b.right = newBVH(sortedObjs[half:], sortedBoxes[half:])
+	b.box = *surroundingBox(&b.left.box, &b.right.box)
+
+	return b
+}
+
 func (b *bvhNode) hit(r ray, tmin, tmax float64, hr *hitRecord) bool {
 	// Check if the bounding box has been hit, if it doesn't hit the box,
 	// it will definitely not hit the object.
-	if b.box.hit(r, tmin, tmax) {
-		// We've hit the box, to get more information about the actual objects, we create to hitrecords.
-		var lhr, rhr *hitRecord
-		// Check which specific object we hit.
-		hitLeft := b.left.hit(r, tmin, tmax, lhr)
-		hitRight := b.right.hit(r, tmin, tmax, rhr)
-		if hitLeft && hitRight {
-			// If we hit both we need to figure out which one is in the front.
-
-		} else if hitLeft {
-			// We only hit the left one.
-			hr = lhr
-			return true
-		} else if hitRight {
-			// We only hit the right one.
-			hr = rhr
-			return true
-		}
-		// We hit nothing this can happen,
-		// because bounding boxes are not perfectly aligned with objects.
+	if !b.box.hit(r, tmin, tmax) {
 		return false
 	}
 
-	return false
+	if b.objs != nil {
+		hitAny := false
+		for _, o := range b.objs {
+			if o.hit(r, tmin, tmax, hr) {
+				hitAny = true
+				tmax = hr.t
+			}
+		}
+		return hitAny
+	}
+
+	// If we hit the left one, the right one has to be closer to count.
+	hitLeft := b.left.hit(r, tmin, tmax, hr)
+	if hitLeft {
+		tmax = hr.t
+	}
+	hitRight := b.right.hit(r, tmin, tmax, hr)
+
+	// We might hit nothing, because bounding boxes are not perfectly aligned with objects.
+	return hitLeft || hitRight
 }
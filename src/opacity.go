@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+)
+
+// How the opacity texture decides if a ray goes through.
+const (
+	// Gray parts let some of the rays through, it's smooth but a bit noisy.
+	opacityStochastic uint8 = 0
+	// Everything darker than half gray is cut out, good for sharp edges like leaves.
+	opacityThreshold uint8 = 1
+)
+
+// Sets an opacity mask, white is solid and black is cut out. Returns the material so calls can be chained.
+// There are no separate shadow rays, so every ray goes through the mask the same way.
+func (m *material) opacityMasked(tex texture, mode uint8) *material {
+	m.opacity = tex
+	m.opacityMode = mode
+	return m
+}
+
+// Tells if the ray goes through the surface at this hit.
+func (m *material) transparentAt(r ray, hr *hitRecord) bool {
+	if m == nil || m.opacity == nil {
+		return false
+	}
+
+	c := texValue(m.opacity, hr)
+	alpha := gray(c)
+	if m.opacityMode == opacityThreshold {
+		return alpha < 0.5
+	}
+
+	if alpha >= 1.0 {
+		return false
+	}
+	if alpha <= 0.0 {
+		return true
+	}
+
+	// The same ray hitting the same point always makes the same choice, so renders don't change between runs.
+	u := toFloat(hash2(hashVec(r.origin)^hashVec(r.dir), hashVec(hr.p)))
+	return u >= alpha
+}
+
+func hashVec(v vec3) uint32 {
+	return hash3(math.Float32bits(float32(v.x)), math.Float32bits(float32(v.y)), math.Float32bits(float32(v.z)))
+}
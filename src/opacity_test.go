@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOpacityThreshold(t *testing.T) {
+	r := ray{origin: vec(0.0, 0.0, 5.0), dir: vec(0.0, 0.0, -1.0)}
+	hr := flatHit(0.5, 0.5)
+
+	if !dif(col(1.0, 1.0, 1.0)).opacityMasked(col(0.3, 0.3, 0.3), opacityThreshold).transparentAt(r, &hr) {
+		t.Error("dark parts should be cut out")
+	}
+	if dif(col(1.0, 1.0, 1.0)).opacityMasked(col(0.7, 0.7, 0.7), opacityThreshold).transparentAt(r, &hr) {
+		t.Error("bright parts should be solid")
+	}
+	if dif(col(1.0, 1.0, 1.0)).transparentAt(r, &hr) {
+		t.Error("without a mask everything is solid")
+	}
+
+	// Rays go right through a sphere that's cut out everywhere.
+	s := sphere(1.0, vec(0.0, 0.0, 0.0), dif(col(1.0, 1.0, 1.0)).opacityMasked(col(0.0, 0.0, 0.0), opacityThreshold))
+	if s.hit(r, 0.001, math.MaxFloat64, &hitRecord{}) {
+		t.Error("the ray hit a sphere that's cut out")
+	}
+}
+
+func TestOpacityStochastic(t *testing.T) {
+	m := dif(col(1.0, 1.0, 1.0)).opacityMasked(col(0.25, 0.25, 0.25), opacityStochastic)
+
+	through := 0
+	n := 10000
+	for i := 0; i < n; i++ {
+		r := ray{origin: vec(float64(i), 0.0, 5.0), dir: vec(0.0, 0.0, -1.0)}
+		hr := flatHit(float64(i), 0.0)
+		if m.transparentAt(r, &hr) {
+			through++
+		}
+
+		// The same ray always makes the same choice.
+		if m.transparentAt(r, &hr) != m.transparentAt(r, &hr) {
+			t.Fatal("the same hit gave two answers")
+		}
+	}
+
+	if f := float64(through) / float64(n); math.Abs(f-0.75) > 0.03 {
+		t.Errorf("%v of the rays went through, want about 0.75", f)
+	}
+}
+
+// A cut out sphere in front of a solid one, in the same leaf of the tree. It can't change the hit behind it.
+func TestOpacityKeepsCloserHit(t *testing.T) {
+	solidMat := dif(col(1.0, 1.0, 1.0))
+	cutMat := dif(col(1.0, 1.0, 1.0)).opacityMasked(col(0.0, 0.0, 0.0), opacityThreshold)
+	solid := sphere(1.0, vec(0.0, 0.0, -10.0), solidMat)
+	cut := sphere(1.0, vec(0.0, 0.0, -6.0), cutMat)
+	r := ray{origin: vec(0.0, 0.0, 0.0), dir: vec(0.0, 0.0, -1.0)}
+
+	lists := map[string][]*object{
+		"solid first":   {solid, cut},
+		"cut first":     {cut, solid},
+		"cut instanced": {solid, instance(cut)},
+	}
+	for name, objs := range lists {
+		for _, built := range []bool{false, true} {
+			scn := &scene{objects: objs}
+			if built {
+				scn.build(0.0, 1.0)
+			}
+
+			hr := hitRecord{}
+			if !scn.hit(r, 0.001, math.MaxFloat64, &hr) {
+				t.Errorf("%s, built %v: the ray hit nothing", name, built)
+				continue
+			}
+			if math.Abs(hr.t-9.0) > 1e-9 || hr.mat != solidMat {
+				t.Errorf("%s, built %v: hit at %v, want the solid sphere at 9", name, built, hr.t)
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// A gradient of colors, the stops are sorted by position and blended linearly between them.
+type colorRamp struct {
+	stops []rampStop
+}
+
+type rampStop struct {
+	pos float64
+	col vec3
+}
+
+func stop(pos float64, col vec3) rampStop {
+	return rampStop{pos, col}
+}
+
+func ramp(stops ...rampStop) *colorRamp {
+	r := &colorRamp{make([]rampStop, len(stops))}
+	copy(r.stops, stops)
+	sort.Slice(r.stops, func(i, j int) bool { return r.stops[i].pos < r.stops[j].pos })
+	return r
+}
+
+// From black at 0 to white at 1, the textures use this when they don't get a ramp.
+func grayRamp() *colorRamp {
+	return ramp(stop(0.0, vec(0.0, 0.0, 0.0)), stop(1.0, vec(1.0, 1.0, 1.0)))
+}
+
+func (r *colorRamp) at(f float64) vec3 {
+	n := len(r.stops)
+	if n == 0 {
+		return vec(f, f, f)
+	}
+	if f <= r.stops[0].pos {
+		return r.stops[0].col
+	}
+	if f >= r.stops[n-1].pos {
+		return r.stops[n-1].col
+	}
+
+	i := sort.Search(n, func(i int) bool { return r.stops[i].pos > f })
+	s0, s1 := r.stops[i-1], r.stops[i]
+	return lerpVec(s0.col, s1.col, (f-s0.pos)/(s1.pos-s0.pos))
+}
+
+// How the octaves of fractal noise are added up.
+type fractalParams struct {
+	octaves    int
+	lacunarity float64 // How much smaller every octave is.
+	gain       float64 // How much weaker every octave is.
+}
+
+func fractal(octaves int, lacunarity, gain float64) fractalParams {
+	return fractalParams{octaves, lacunarity, gain}
+}
+
+// Kinds of fractal noise.
+const (
+	fracFBM        uint8 = 0 // Soft clouds.
+	fracTurbulence uint8 = 1 // Billowy, with creases.
+	fracRidged     uint8 = 2 // Sharp ridges.
+)
+
+type fractalTex struct {
+	kind  uint8
+	noise noiseGen
+	scale float64
+	frac  fractalParams
+	ramp  *colorRamp
+}
+
+// Fractal noise of a kind, like fracRidged, the noise is scale times smaller than the scene. Ramp can be nil for gray.
+func fractalNoise(kind uint8, noise noiseGen, scale float64, frac fractalParams, r *colorRamp) *fractalTex {
+	if r == nil {
+		r = grayRamp()
+	}
+	return &fractalTex{kind, noise, scale, frac, r}
+}
+
+func (t *fractalTex) value(u, v float64, p vec3) vec3 {
+	q := p.mulScalar(t.scale)
+
+	var f float64
+	switch t.kind {
+	case fracTurbulence:
+		f = turbulence(t.noise, q, t.frac)
+	case fracRidged:
+		f = ridged(t.noise, q, t.frac)
+	default:
+		f = 0.5 + 0.5*fbm(t.noise, q, t.frac)
+	}
+
+	return t.ramp.at(f)
+}
+
+// Marble has veins of turbulence along a sine wave, amount is how much the veins wander.
+type marbleTex struct {
+	noise  noiseGen
+	scale  float64
+	amount float64
+	frac   fractalParams
+	ramp   *colorRamp
+}
+
+func marble(noise noiseGen, scale, amount float64, frac fractalParams, r *colorRamp) *marbleTex {
+	if r == nil {
+		r = grayRamp()
+	}
+	return &marbleTex{noise, scale, amount, frac, r}
+}
+
+func (t *marbleTex) value(u, v float64, p vec3) vec3 {
+	veins := math.Abs(fbm(t.noise, p, t.frac))
+	return t.ramp.at(0.5 * (1.0 + math.Sin(t.scale*p.z+t.amount*veins)))
+}
+
+// Rings around the y axis, like the trunk of a tree that stands up. The noise makes the rings wobble.
+type woodTex struct {
+	noise  noiseGen
+	rings  float64 // Rings per unit.
+	amount float64
+	frac   fractalParams
+	ramp   *colorRamp
+}
+
+func wood(noise noiseGen, rings, amount float64, frac fractalParams, r *colorRamp) *woodTex {
+	if r == nil {
+		r = ramp(stop(0.0, vec(0.6, 0.4, 0.2)), stop(0.8, vec(0.4, 0.25, 0.1)), stop(1.0, vec(0.6, 0.4, 0.2)))
+	}
+	return &woodTex{noise, rings, amount, frac, r}
+}
+
+func (t *woodTex) value(u, v float64, p vec3) vec3 {
+	dist := math.Sqrt(p.x*p.x+p.z*p.z) * t.rings
+	dist += t.amount * fbm(t.noise, p, t.frac)
+	return t.ramp.at(dist - math.Floor(dist))
+}
+
+// What the cellular texture shows.
+const (
+	worleyF1    uint8 = 0 // Distance to the closest point, round cells.
+	worleyF2    uint8 = 1 // Distance to the second closest point.
+	worleyEdges uint8 = 2 // F2 - F1, dark lines between the cells.
+)
+
+// Cellular noise, every cell of a grid has a random point in it and the texture depends on the distance to them.
+type worleyTex struct {
+	scale   float64
+	seed    uint32
+	feature uint8
+	ramp    *colorRamp
+}
+
+func worley(scale float64, seed int64, feature uint8, r *colorRamp) *worleyTex {
+	if r == nil {
+		r = grayRamp()
+	}
+	return &worleyTex{scale, uint32(seed), feature, r}
+}
+
+func (t *worleyTex) value(u, v float64, p vec3) vec3 {
+	q := p.mulScalar(t.scale)
+	cx, cy, cz := math.Floor(q.x), math.Floor(q.y), math.Floor(q.z)
+
+	// The closest point can only be in this cell or one next to it.
+	f1, f2 := math.MaxFloat64, math.MaxFloat64
+	for dz := -1.0; dz <= 1.0; dz++ {
+		for dy := -1.0; dy <= 1.0; dy++ {
+			for dx := -1.0; dx <= 1.0; dx++ {
+				x, y, z := cx+dx, cy+dy, cz+dz
+				h := hash3(uint32(int32(x))^t.seed, uint32(int32(y)), uint32(int32(z)))
+				point := vec(
+					x+toFloat(h),
+					y+toFloat(mix32(h^0x9e3779b9)),
+					z+toFloat(mix32(h^0x7f4a7c15)),
+				)
+
+				d := point.sub(q).length()
+				if d < f1 {
+					f1, f2 = d, f1
+				} else if d < f2 {
+					f2 = d
+				}
+			}
+		}
+	}
+
+	switch t.feature {
+	case worleyF2:
+		return t.ramp.at(f2)
+	case worleyEdges:
+		return t.ramp.at(f2 - f1)
+	default:
+		return t.ramp.at(f1)
+	}
+}
+
+// Goes from 0 at from to 1 at to, straight through the scene.
+type gradientTex struct {
+	from, to vec3
+	ramp     *colorRamp
+}
+
+func gradient(from, to vec3, r *colorRamp) *gradientTex {
+	if r == nil {
+		r = grayRamp()
+	}
+	return &gradientTex{from, to, r}
+}
+
+func (t *gradientTex) value(u, v float64, p vec3) vec3 {
+	d := t.to.sub(t.from)
+	return t.ramp.at(dot(p.sub(t.from), d) / d.lengthSqr())
+}
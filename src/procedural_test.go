@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Goes from 0 to 10 without clamping anything in between, so the textures show their raw values.
+func linearRamp() *colorRamp {
+	return ramp(stop(0.0, vec(0.0, 0.0, 0.0)), stop(10.0, vec(10.0, 10.0, 10.0)))
+}
+
+func TestColorRamp(t *testing.T) {
+	r := ramp(stop(1.0, vec(0.0, 0.0, 1.0)), stop(0.0, vec(1.0, 0.0, 0.0)), stop(0.5, vec(0.0, 1.0, 0.0)))
+
+	cases := map[float64]vec3{
+		-1.0: vec(1.0, 0.0, 0.0),
+		0.25: vec(0.5, 0.5, 0.0),
+		0.5:  vec(0.0, 1.0, 0.0),
+		0.75: vec(0.0, 0.5, 0.5),
+		2.0:  vec(0.0, 0.0, 1.0),
+	}
+	for f, want := range cases {
+		if got := r.at(f); !vecNear(got, want) {
+			t.Errorf("at(%v) = %v, want %v", f, got, want)
+		}
+	}
+}
+
+func TestFractalNoise(t *testing.T) {
+	n := noiseFor(noiseImproved, 1)
+	frac := fractal(5, 2.0, 0.5)
+
+	for i := 0; i < 1000; i++ {
+		p := vec(float64(i)*0.137, float64(i)*0.071, float64(i)*-0.113)
+
+		if r := ridged(n, p, frac); r < 0.0 || r > 1.0 {
+			t.Fatalf("ridged(%v) = %v, want 0 to 1", p, r)
+		}
+		if tb := turbulence(n, p, frac); tb < 0.0 {
+			t.Fatalf("turbulence(%v) = %v, want at least 0", p, tb)
+		}
+
+		// The textures only scale the point and look up the same noise.
+		tex := fractalNoise(fracRidged, n, 2.0, frac, linearRamp())
+		if got, want := tex.value(0.0, 0.0, p).x, ridged(n, p.mulScalar(2.0), frac); math.Abs(got-want) > 1e-9 {
+			t.Fatalf("ridged texture is %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWorley(t *testing.T) {
+	f1 := worley(3.0, 7, worleyF1, linearRamp())
+	f2 := worley(3.0, 7, worleyF2, linearRamp())
+	edges := worley(3.0, 7, worleyEdges, linearRamp())
+	other := worley(3.0, 8, worleyF1, linearRamp())
+
+	differs := false
+	for i := 0; i < 500; i++ {
+		p := vec(float64(i)*0.0311, float64(i)*0.0173, 0.5)
+		a, b, e := f1.value(0.0, 0.0, p).x, f2.value(0.0, 0.0, p).x, edges.value(0.0, 0.0, p).x
+
+		if a < 0.0 || a > b {
+			t.Fatalf("at %v F1 is %v and F2 %v", p, a, b)
+		}
+		// The closest point is at most half the diagonal of a cell away.
+		if a > math.Sqrt(3.0) {
+			t.Fatalf("at %v F1 is %v, that's further than a cell", p, a)
+		}
+		if math.Abs(e-(b-a)) > 1e-9 {
+			t.Fatalf("at %v the edges are %v, want %v", p, e, b-a)
+		}
+		if other.value(0.0, 0.0, p).x != a {
+			differs = true
+		}
+	}
+
+	if !differs {
+		t.Error("another seed gives the same cells")
+	}
+}
+
+func TestWoodAndMarble(t *testing.T) {
+	n := noiseFor(noiseClassic, 1)
+	frac := fractal(4, 2.0, 0.5)
+
+	// Without the noise the rings repeat every 1/rings. Stay away from the edges between them, the next ring starts there.
+	w := wood(n, 4.0, 0.0, frac, linearRamp())
+	for i := 0; i < 20; i++ {
+		r := 0.03 + 0.1*float64(i)
+		a := w.value(0.0, 0.0, vec(r, 0.3, 0.0)).x
+		b := w.value(0.0, 0.0, vec(0.0, 0.3, r+0.25)).x
+		if math.Abs(a-b) > 1e-9 {
+			t.Errorf("wood at radius %v is %v and one ring further %v", r, a, b)
+		}
+	}
+
+	// And marble is just the sine.
+	m := marble(n, 3.0, 0.0, frac, linearRamp())
+	for z := -2.0; z < 2.0; z += 0.1 {
+		want := 0.5 * (1.0 + math.Sin(3.0*z))
+		if got := m.value(0.0, 0.0, vec(0.2, 0.4, z)).x; math.Abs(got-want) > 1e-9 {
+			t.Errorf("marble at z %v is %v, want %v", z, got, want)
+		}
+	}
+}
+
+func TestGradient(t *testing.T) {
+	g := gradient(vec(0.0, 1.0, 0.0), vec(0.0, 3.0, 0.0), nil)
+
+	cases := map[float64]float64{0.0: 0.0, 1.0: 0.0, 2.0: 0.5, 3.0: 1.0, 5.0: 1.0}
+	for y, want := range cases {
+		// Moving sideways doesn't matter.
+		if got := g.value(0.0, 0.0, vec(4.0, y, -2.0)); !vecNear(got, vec(want, want, want)) {
+			t.Errorf("gradient at y %v is %v, want %v", y, got, want)
+		}
+	}
+}
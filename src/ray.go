@@ -2,13 +2,18 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
 // ray is used for tracing a line from a origin(O) in a direction(Dir).
 type ray struct {
 	origin, dir vec3
-	time float64
+	time        float64
+
+	// Where the rays through the neighbouring pixels go, textures use it to see how much they need to blur.
+	diff rayDiff
+
+	// The wavelengths of the path in spectral mode, nil otherwise.
+	wl *wavelengths
 }
 
 // PointAtParam gets a vec3 position at a certain distance across the line.
@@ -17,9 +22,14 @@ func (r *ray) point(t float64) vec3 {
 }
 
 // Color returns a color based on what the ray hits.
-func (r *ray) color(s *scene, depth int64, rnd *rand.Rand) vec3 {
+func (r *ray) color(s *scene, depth int64, rnd sampler) vec3 {
+	rnd.startBounce(int(depth))
+
 	hr := hitRecord{}
 	if s.hit(*r, 0.001, math.MaxFloat64, &hr) {
+		hr.differentials(*r)
+		hr.mat.perturb(&hr)
+
 		scattered := ray{}
 		attenuation := vec3{}
 		if depth < 50 && hr.mat.scatter(*r, &hr, &attenuation, &scattered, rnd) {
@@ -28,7 +38,12 @@ func (r *ray) color(s *scene, depth int64, rnd *rand.Rand) vec3 {
 		return vec(0.0, 0.0, 0.0)
 	}
 
-	nd := r.dir.normalize()
+	return sky(r.dir)
+}
+
+// The color of the background in a direction.
+func sky(dir vec3) vec3 {
+	nd := dir.normalize()
 	t := 0.5 * (nd.y + 1.0)
 
 	// 		(1.0-t) * (1.0, 1.0, 1.0) + t * (0.5, 0.7, 1.0)
@@ -37,11 +52,13 @@ func (r *ray) color(s *scene, depth int64, rnd *rand.Rand) vec3 {
 	return temp
 }
 
-func randInUnitSphere(rnd *rand.Rand) vec3 {
-	p := vec(rnd.Float64(), rnd.Float64(), rnd.Float64()).mulScalar(2.0).sub(vec(1.0, 1.0, 1.0))
-	for p.lengthSqr() >= 1.0 {
-		p = vec(rnd.Float64(), rnd.Float64(), rnd.Float64()).mulScalar(2.0).sub(vec(1.0, 1.0, 1.0))
-	}
+// Picks a random direction and then a random distance, the cube root
+// makes sure the points are spread evenly over the volume.
+func randInUnitSphere(rnd sampler) vec3 {
+	u, v := rnd.get2D()
+	z := 1.0 - 2.0*u
+	r := math.Sqrt(math.Max(0.0, 1.0-z*z))
+	phi := 2.0 * math.Pi * v
 
-	return p
+	return vec(r*math.Cos(phi), r*math.Sin(phi), z).mulScalar(math.Cbrt(rnd.get1D()))
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+)
+
+// Use these to pick the way samples are generated.
+const (
+	smpIndependent uint8 = 0
+	smpStratified  uint8 = 1
+	smpHalton      uint8 = 2
+	smpSobol       uint8 = 3
+)
+
+// The sampler for a name from the command line.
+func samplerMethod(name string) (uint8, error) {
+	switch name {
+	case "independent":
+		return smpIndependent, nil
+	case "stratified":
+		return smpStratified, nil
+	case "halton":
+		return smpHalton, nil
+	case "sobol":
+		return smpSobol, nil
+	}
+
+	return 0, fmt.Errorf("unknown sampler %q, use: independent, stratified, halton or sobol", name)
+}
+
+// The camera always uses the first dimensions of a sample (film position, lens and time),
+// after that every bounce gets its own block. This way the same dimension is always used
+// for the same decision, which is what makes the low-discrepancy samplers work.
+const (
+	cameraDims = 8
+	bounceDims = 4
+)
+
+// A sampler hands out the random numbers for a single sample, one dimension at a time.
+// Samplers are not safe for concurrent use, every goroutine needs its own.
+type sampler interface {
+	startPixel(x, y int)
+	startSample(index int)
+	startBounce(depth int)
+	get1D() float64
+	get2D() (float64, float64)
+}
+
+// Every sampler with the same seed and stream gives the same numbers, the stream is
+// used to give every goroutine its own random numbers.
+func newSampler(method uint8, spp int, seed int64, stream int) sampler {
+	base := samplerBase{
+		rnd:  rand.New(rand.NewSource(int64(hash3(uint32(seed), uint32(seed>>32), uint32(stream))))),
+		seed: hash2(uint32(seed), uint32(seed>>32)),
+		spp:  spp,
+	}
+
+	switch method {
+	case smpStratified:
+		return &stratifiedSampler{base}
+	case smpHalton:
+		return &haltonSampler{base}
+	case smpSobol:
+		return &sobolSampler{base}
+	default:
+		return &independentSampler{base}
+	}
+}
+
+// Keeps track of where we are, shared by all the samplers.
+type samplerBase struct {
+	rnd        *rand.Rand
+	seed       uint32
+	pixelSeed  uint32
+	spp        int
+	index, dim int
+}
+
+func (s *samplerBase) startPixel(x, y int) {
+	s.pixelSeed = hash3(s.seed, uint32(x), uint32(y))
+}
+
+func (s *samplerBase) startSample(index int) {
+	s.index = index
+	s.dim = 0
+}
+
+func (s *samplerBase) startBounce(depth int) {
+	s.dim = cameraDims + depth*bounceDims
+}
+
+// Plain random numbers, this is what we used to do.
+type independentSampler struct {
+	samplerBase
+}
+
+func (s *independentSampler) get1D() float64 {
+	s.dim++
+	return s.rnd.Float64()
+}
+
+func (s *independentSampler) get2D() (float64, float64) {
+	s.dim += 2
+	return s.rnd.Float64(), s.rnd.Float64()
+}
+
+// Jittered samples, every sample of a pixel falls in its own stratum. The strata are
+// shuffled per pixel and per dimension, so the dimensions don't line up with each other.
+type stratifiedSampler struct {
+	samplerBase
+}
+
+func (s *stratifiedSampler) get1D() float64 {
+	n := uint32(s.spp)
+	stratum := hashPermute(uint32(s.index)%n, n, hash2(s.pixelSeed, uint32(s.dim)))
+	s.dim++
+
+	return (float64(stratum) + s.rnd.Float64()) / float64(n)
+}
+
+func (s *stratifiedSampler) get2D() (float64, float64) {
+	// Use a grid that is as square as possible, the leftover samples wrap around.
+	nx := int(math.Sqrt(float64(s.spp)))
+	if nx < 1 {
+		nx = 1
+	}
+	ny := s.spp / nx
+	n := uint32(nx * ny)
+
+	stratum := int(hashPermute(uint32(s.index)%n, n, hash2(s.pixelSeed, uint32(s.dim))))
+	s.dim += 2
+
+	x := (float64(stratum%nx) + s.rnd.Float64()) / float64(nx)
+	y := (float64(stratum/nx) + s.rnd.Float64()) / float64(ny)
+	return x, y
+}
+
+// The first primes, one for every dimension of the Halton sequence.
+var haltonPrimes = [...]uint32{
+	2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53,
+	59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131,
+}
+
+// Halton sequence, every pixel gets a random shift (Cranley-Patterson rotation)
+// so neighbouring pixels don't use the exact same points.
+type haltonSampler struct {
+	samplerBase
+}
+
+func (s *haltonSampler) get1D() float64 {
+	// We've run out of primes, just use random numbers for the deep bounces.
+	if s.dim >= len(haltonPrimes) {
+		s.dim++
+		return s.rnd.Float64()
+	}
+
+	x := radicalInverse(haltonPrimes[s.dim], uint32(s.index))
+	x += toFloat(hash2(s.pixelSeed, uint32(s.dim)))
+	if x >= 1.0 {
+		x -= 1.0
+	}
+	s.dim++
+
+	return x
+}
+
+func (s *haltonSampler) get2D() (float64, float64) {
+	return s.get1D(), s.get1D()
+}
+
+func radicalInverse(base, i uint32) float64 {
+	inv := 1.0 / float64(base)
+	f := inv
+	r := 0.0
+	for i > 0 {
+		r += f * float64(i%base)
+		i /= base
+		f *= inv
+	}
+
+	return r
+}
+
+// Owen scrambled Sobol sequence, as described by Burley in "Practical Hash-based Owen Scrambling".
+// We only have four real Sobol dimensions, every next group of four gets a different
+// scramble and shuffle, which is known as padding.
+type sobolSampler struct {
+	samplerBase
+}
+
+func (s *sobolSampler) get1D() float64 {
+	seed := hash2(s.pixelSeed, uint32(s.dim/4))
+	index := nestedUniformScramble(uint32(s.index), seed)
+
+	d := uint32(s.dim % 4)
+	x := nestedUniformScramble(sobol(index, d), hashCombine(seed, d))
+	s.dim++
+
+	return toFloat(x)
+}
+
+func (s *sobolSampler) get2D() (float64, float64) {
+	return s.get1D(), s.get1D()
+}
+
+var sobolDirs = sobolDirections()
+
+// Calculates the direction numbers for the first four dimensions,
+// using the primitive polynomials and initial numbers of Joe and Kuo.
+func sobolDirections() [4][32]uint32 {
+	var v [4][32]uint32
+
+	// The first dimension is just the van der Corput sequence.
+	for i := 0; i < 32; i++ {
+		v[0][i] = 1 << uint(31-i)
+	}
+
+	params := [3]struct {
+		s, a uint32
+		m    []uint32
+	}{
+		{1, 0, []uint32{1}},
+		{2, 1, []uint32{1, 3}},
+		{3, 1, []uint32{1, 3, 1}},
+	}
+
+	for d, p := range params {
+		dir := &v[d+1]
+		for i := uint32(0); i < 32; i++ {
+			if i < p.s {
+				dir[i] = p.m[i] << (31 - i)
+				continue
+			}
+
+			dir[i] = dir[i-p.s] ^ (dir[i-p.s] >> p.s)
+			for k := uint32(1); k < p.s; k++ {
+				dir[i] ^= ((p.a >> (p.s - 1 - k)) & 1) * dir[i-k]
+			}
+		}
+	}
+
+	return v
+}
+
+func sobol(index, dim uint32) uint32 {
+	x := uint32(0)
+	for i := 0; index != 0; i++ {
+		if index&1 != 0 {
+			x ^= sobolDirs[dim][i]
+		}
+		index >>= 1
+	}
+
+	return x
+}
+
+func nestedUniformScramble(x, seed uint32) uint32 {
+	x = bits.Reverse32(x)
+
+	// Laine-Karras style permutation, with the constants from Burley.
+	x += seed
+	x ^= x * 0x6c50b47c
+	x ^= x * 0xb82f1e52
+	x ^= x * 0xc7afe638
+	x ^= x * 0x8d22f6e6
+
+	return bits.Reverse32(x)
+}
+
+// Kensler's hashed permutation, it shuffles i within [0, l) without storing a table.
+func hashPermute(i, l, p uint32) uint32 {
+	w := l - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+
+	for {
+		i ^= p
+		i *= 0xe170893d
+		i ^= p >> 16
+		i ^= (i & w) >> 4
+		i ^= p >> 8
+		i *= 0x0929eb3f
+		i ^= p >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | p>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < l {
+			break
+		}
+	}
+
+	return (i + p) % l
+}
+
+func mix32(x uint32) uint32 {
+	x ^= x >> 16
+	x *= 0x7feb352d
+	x ^= x >> 15
+	x *= 0x846ca68b
+	x ^= x >> 16
+	return x
+}
+
+func hash2(a, b uint32) uint32 {
+	return mix32(a ^ mix32(b))
+}
+
+func hash3(a, b, c uint32) uint32 {
+	return mix32(a ^ mix32(b^mix32(c)))
+}
+
+func hashCombine(seed, v uint32) uint32 {
+	return seed ^ (v + (seed << 6) + (seed >> 2))
+}
+
+// Turns 32 random bits into a float in [0, 1).
+func toFloat(x uint32) float64 {
+	return float64(x) / 4294967296.0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+var samplerNames = []string{"independent", "stratified", "halton", "sobol"}
+
+func TestSamplersInRange(t *testing.T) {
+	for _, name := range samplerNames {
+		method, err := samplerMethod(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, spp := range []int{1, 3, 16} {
+			s := newSampler(method, spp, 7, 0)
+			for p := 0; p < 20; p++ {
+				s.startPixel(p*13, p*7)
+				for i := 0; i < spp; i++ {
+					s.startSample(i)
+					var xs []float64
+					for d := 0; d < cameraDims/2; d++ {
+						x, y := s.get2D()
+						xs = append(xs, x, y)
+					}
+					// Deep enough that Halton runs out of primes.
+					for depth := 0; depth < 10; depth++ {
+						s.startBounce(depth)
+						xs = append(xs, s.get1D())
+						x, y := s.get2D()
+						xs = append(xs, x, y)
+					}
+
+					for d, x := range xs {
+						if x < 0.0 || x >= 1.0 {
+							t.Fatalf("%s with %d samples gave %v for number %d of sample %d", name, spp, x, d, i)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := samplerMethod("random"); err == nil {
+		t.Error("an unknown sampler should give an error")
+	}
+}
+
+// Every sample of a pixel has to fall in its own stratum, for the camera and for the bounces.
+func TestSamplersStratify(t *testing.T) {
+	for _, method := range []uint8{smpStratified, smpSobol} {
+		for _, spp := range []int{4, 16, 64} {
+			s := newSampler(method, spp, 3, 0)
+			for p := 0; p < 10; p++ {
+				s.startPixel(p, 2*p)
+
+				// Dimensions 0 and 1 of the camera, and the first one of the third bounce.
+				hit := make([][]bool, 3)
+				for d := range hit {
+					hit[d] = make([]bool, spp)
+				}
+				for i := 0; i < spp; i++ {
+					s.startSample(i)
+					x := s.get1D()
+					y := s.get1D()
+					s.startBounce(2)
+					b := s.get1D()
+
+					for d, v := range []float64{x, y, b} {
+						k := int(v * float64(spp))
+						if hit[d][k] {
+							t.Fatalf("sampler %d with %d samples put two of them in stratum %d of dimension %d", method, spp, k, d)
+						}
+						hit[d][k] = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// The lens and film get two dimensions at once, those have to cover the square evenly too.
+func TestSamplersStratify2D(t *testing.T) {
+	for _, method := range []uint8{smpStratified, smpSobol} {
+		for _, n := range []int{2, 4, 8} {
+			spp := n * n
+			s := newSampler(method, spp, 5, 0)
+			s.startPixel(4, 9)
+
+			hit := make([]bool, spp)
+			for i := 0; i < spp; i++ {
+				s.startSample(i)
+				x, y := s.get2D()
+				k := int(y*float64(n))*n + int(x*float64(n))
+				if hit[k] {
+					t.Fatalf("sampler %d with %d samples put two of them in cell %d", method, spp, k)
+				}
+				hit[k] = true
+			}
+		}
+	}
+}
+
+func TestHashPermute(t *testing.T) {
+	for _, l := range []uint32{1, 2, 5, 16, 100} {
+		for _, p := range []uint32{0, 1, 0xdeadbeef} {
+			seen := make([]bool, l)
+			for i := uint32(0); i < l; i++ {
+				j := hashPermute(i, l, p)
+				if j >= l || seen[j] {
+					t.Fatalf("hashPermute with length %d and seed %x isn't a shuffle, %d went to %d", l, p, i, j)
+				}
+				seen[j] = true
+			}
+		}
+	}
+}
+
+func TestSobolDirections(t *testing.T) {
+	// The first points of the second dimension, from Joe and Kuo.
+	want := []float64{0.0, 0.5, 0.75, 0.25, 0.625, 0.125, 0.375, 0.875}
+	for i, w := range want {
+		if got := toFloat(sobol(uint32(i), 1)); got != w {
+			t.Errorf("point %d of dimension 1 is %v, want %v", i, got, w)
+		}
+	}
+
+	if got := radicalInverse(3, 5); math.Abs(got-7.0/9.0) > 1e-12 {
+		t.Errorf("radicalInverse(3, 5) = %v, want 7/9", got)
+	}
+}
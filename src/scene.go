@@ -8,6 +8,36 @@ import (
 type scene struct {
 	cam     *camera
 	objects []*object
+
+	// The camera can follow a path for animations, it's nil when the camera stands still.
+	path *cameraPath
+
+	// Made by build, the objects without a bounding box are checked one by one.
+	bvh       *bvhNode
+	unbounded []*object
+}
+
+// Builds the BVH for everything that happens between t0 and t1. It only depends on the objects,
+// so it can be used for every camera and every frame.
+func (s *scene) build(t0, t1 float64) {
+	var objs []*object
+	var boxes []aabb
+	s.unbounded = nil
+
+	for _, o := range s.objects {
+		box := aabb{}
+		if o.boundingBox(t0, t1, &box) {
+			objs = append(objs, o)
+			boxes = append(boxes, box)
+		} else {
+			s.unbounded = append(s.unbounded, o)
+		}
+	}
+
+	s.bvh = nil
+	if len(objs) > 0 {
+		s.bvh = newBVH(objs, boxes)
+	}
 }
 
 func (s *scene) hit(r ray, tmin float64, tmax float64, hr *hitRecord) bool {
@@ -15,8 +45,18 @@ func (s *scene) hit(r ray, tmin float64, tmax float64, hr *hitRecord) bool {
 	closestSoFar := tmax  // We haven't hit anything, so there's no closest.
 	tempHr := hitRecord{} // Create an empty hit record.
 
-	for i := 0; i < len(s.objects); i++ {
-		if s.objects[i].hit(r, tmin, closestSoFar, &tempHr) {
+	objects := s.objects
+	if s.bvh != nil {
+		if s.bvh.hit(r, tmin, closestSoFar, &tempHr) {
+			hitAny = true
+			closestSoFar = tempHr.t
+			*hr = tempHr
+		}
+		objects = s.unbounded
+	}
+
+	for i := 0; i < len(objects); i++ {
+		if objects[i].hit(r, tmin, closestSoFar, &tempHr) {
 			// We've hit something!
 			hitAny = true
 			// We want our objects to be closer than this one.
@@ -36,15 +76,15 @@ func (s *scene) boundingBox(t0, t1 float64, box *aabb) bool {
 		return false
 	}
 	// Check if we even hit the first one.
-	var tempBox *aabb
-	if !s.objects[0].boundingBox(t0, t1, tempBox) {
+	tempBox := aabb{}
+	if !s.objects[0].boundingBox(t0, t1, &tempBox) {
 		return false
 	}
-	box = tempBox
+	*box = tempBox
 	// Now create a bounding box for all the objects.
 	for i := 1; i < len(s.objects); i++ {
-		if s.objects[1].boundingBox(t0, t1, tempBox) {
-			box = surroundingBox(box, tempBox)
+		if s.objects[i].boundingBox(t0, t1, &tempBox) {
+			*box = *surroundingBox(box, &tempBox)
 		} else {
 			return false
 		}
@@ -53,9 +93,12 @@ func (s *scene) boundingBox(t0, t1 float64, box *aabb) bool {
 	return true
 }
 
-func randScene() *scene {
+func randScene(seed int64) *scene {
+	// Everything random in the scene comes from the seed, so it looks the same every time.
+	rnd := rand.New(rand.NewSource(seed))
+
 	checkerMat := dif(checker(vec(0.2, 0.3, 0.1), vec(0.9, 0.9, 0.9)))
-	marbleMat := dif(perlTex(4.0))
+	marbleMat := dif(perlTex(4.0, noiseFor(noiseClassic, seed)))
 	texMat := dif(createImageTex("../res/texture.png"))
 
 	// List of objects.
@@ -68,15 +111,15 @@ func randScene() *scene {
 
 	for a := -2; a < 2; a++ {
 		for b := -2; b < 2; b++ {
-			chooseMat := rand.Float64()
-			center := vec(float64(a)+0.9*rand.Float64(), 0.2, float64(b)+0.9*rand.Float64())
+			chooseMat := rnd.Float64()
+			center := vec(float64(a)+0.9*rnd.Float64(), 0.2, float64(b)+0.9*rnd.Float64())
 
 			if center.sub(vec(4.0, 0.2, 0.0)).length() > 0.9 {
 				if chooseMat < 0.6 { // Diffuse
-					objList = append(objList, sphere(0.2, center, dif(col(rand.Float64()*rand.Float64(), rand.Float64()*rand.Float64(), rand.Float64()*rand.Float64()))))
+					objList = append(objList, sphere(0.2, center, dif(col(rnd.Float64()*rnd.Float64(), rnd.Float64()*rnd.Float64(), rnd.Float64()*rnd.Float64()))))
 				} else if chooseMat < 0.8 { // Metal
-					objList = append(objList, sphere(0.2, center, met(col(0.5*(1+rand.Float64()), 0.5*(1+rand.Float64()), 0.5*(1+rand.Float64())), 0.5*rand.Float64())))
-				} else if chooseMat < 0.9{ // Glass
+					objList = append(objList, sphere(0.2, center, met(col(0.5*(1+rnd.Float64()), 0.5*(1+rnd.Float64()), 0.5*(1+rnd.Float64())), 0.5*rnd.Float64())))
+				} else if chooseMat < 0.9 { // Glass
 					objList = append(objList, sphere(0.2, center, glass(1.5)))
 				} else { // Marble
 					objList = append(objList, sphere(0.2, center, marbleMat))
@@ -85,7 +128,14 @@ func randScene() *scene {
 		}
 	}
 
+	// The camera flies around the spheres when rendering an animation.
+	path := camPath(true,
+		camKey(0.0, vec(13.0, 2.0, 3.0), vec(0.0, 0.0, 0.0), 20.0, 10.0),
+		camKey(30.0, vec(3.0, 3.0, 13.0), vec(0.0, 0.5, 0.0), 25.0, 10.0),
+		camKey(60.0, vec(-13.0, 2.0, 3.0), vec(0.0, 0.0, 0.0), 20.0, 10.0),
+	)
+
 	// Create a scene, containing a camera and a list of objects to render.
-	return &scene{cam(vec(13.0, 2.0, 3.0), vec(0.0, 0.0, 0.0), 20.0, 0.15, 1.0),
-		objList}
+	return &scene{cam: cam(vec(13.0, 2.0, 3.0), vec(0.0, 0.0, 0.0), 20.0, 0.15, 10.0, 1.0),
+		objects: objList, path: path}
 }
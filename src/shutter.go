@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Real shutters don't open and close instantly, the curve tells how much light gets
+// through during the time the shutter is open. It goes from 0 (opening) to 1 (closed)
+// and is linear between the points.
+type shutterCurve struct {
+	xs, ys []float64
+	cdf    []float64 // Area under the curve up to every point.
+}
+
+func newShutterCurve(xs, ys []float64) *shutterCurve {
+	for i := range xs {
+		if ys[i] < 0.0 || (i > 0 && xs[i] < xs[i-1]) {
+			panic("shutter curve needs increasing times and values of at least zero")
+		}
+	}
+
+	c := &shutterCurve{xs, ys, make([]float64, len(xs))}
+	for i := 1; i < len(xs); i++ {
+		c.cdf[i] = c.cdf[i-1] + (xs[i]-xs[i-1])*(ys[i-1]+ys[i])/2.0
+	}
+
+	if c.cdf[len(c.cdf)-1] <= 0.0 {
+		panic("shutter curve doesn't let any light through")
+	}
+
+	return c
+}
+
+// The values are spread evenly over the time the shutter is open.
+func tabulatedShutter(values ...float64) *shutterCurve {
+	if len(values) < 2 {
+		panic("shutter curve needs at least two values")
+	}
+
+	xs := make([]float64, len(values))
+	for i := range xs {
+		xs[i] = float64(i) / float64(len(values)-1)
+	}
+	return newShutterCurve(xs, values)
+}
+
+// Opens and closes linearly, ramp is the part of the time spent opening (and closing again).
+func trapezoidShutter(ramp float64) *shutterCurve {
+	ramp = math.Max(0.0, math.Min(0.5, ramp))
+	return newShutterCurve([]float64{0.0, ramp, 1.0 - ramp, 1.0}, []float64{0.0, 1.0, 1.0, 0.0})
+}
+
+// Turns a uniform sample into a moment between 0 and 1, more samples end up where the shutter lets more light through.
+func (c *shutterCurve) sample(u float64) float64 {
+	target := u * c.cdf[len(c.cdf)-1]
+	i := sort.Search(len(c.cdf), func(i int) bool { return c.cdf[i] > target })
+	if i < 1 {
+		i = 1
+	}
+	if i >= len(c.cdf) {
+		i = len(c.cdf) - 1
+	}
+	// Segments without any light can't be solved, and samples never belong there anyway.
+	// That only happens at the very end, when u is 1.
+	for i > 1 && c.cdf[i] <= c.cdf[i-1] {
+		i--
+	}
+
+	// Within a segment the curve is a line from a to b, so solve the area of that trapezoid for x.
+	width := c.xs[i] - c.xs[i-1]
+	area := (target - c.cdf[i-1]) / width
+	a, b := c.ys[i-1], c.ys[i]
+
+	var x float64
+	if math.Abs(b-a) < 1e-9 {
+		x = area / a
+	} else {
+		x = (-a + math.Sqrt(math.Max(0.0, a*a+2.0*(b-a)*area))) / (b - a)
+	}
+	x = math.Max(0.0, math.Min(1.0, x))
+
+	return c.xs[i-1] + x*width
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Curves with parts that let no light through, or with two points at the same time, still give good times.
+func TestShutterSampleNoNaN(t *testing.T) {
+	curves := map[string]*shutterCurve{
+		"instant":   trapezoidShutter(0.0),
+		"trapezoid": trapezoidShutter(0.25),
+		"dark end":  tabulatedShutter(0.0, 1.0, 0.0, 0.0, 0.0),
+		"dark mid":  tabulatedShutter(1.0, 0.0, 0.0, 1.0),
+		"repeated":  newShutterCurve([]float64{0.0, 0.5, 0.5, 1.0}, []float64{1.0, 1.0, 0.0, 0.0}),
+	}
+
+	for name, c := range curves {
+		for i := 0; i <= 100; i++ {
+			x := c.sample(float64(i) / 100.0)
+			if math.IsNaN(x) || x < 0.0 || x > 1.0 {
+				t.Fatalf("%s: sample(%v) = %v", name, float64(i)/100.0, x)
+			}
+		}
+	}
+
+	// Nothing gets through between 1/3 and 2/3.
+	c := curves["dark mid"]
+	for i := 1; i < 100; i++ {
+		if x := c.sample(float64(i) / 100.0); x > 1.0/3.0+1e-9 && x < 2.0/3.0-1e-9 {
+			t.Fatalf("sample(%v) = %v is where the shutter is closed", float64(i)/100.0, x)
+		}
+	}
+}
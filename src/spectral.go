@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math"
+)
+
+// Every path carries this many wavelengths, the first one is the hero that decides when they can't agree.
+const numWavelengths = 4
+
+// Light at the wavelengths of a path, one value for every wavelength.
+type spectrum [numWavelengths]float64
+
+func (s spectrum) mul(o spectrum) spectrum {
+	for i := range s {
+		s[i] *= o[i]
+	}
+	return s
+}
+
+// The wavelengths in nm a path is traced for, they're shared by all the rays of the path.
+type wavelengths struct {
+	lambda [numWavelengths]float64
+	pdf    [numWavelengths]float64
+}
+
+// Picks the wavelengths for a path, spread evenly over the visible spectrum with u deciding where they start.
+// The middle of the spectrum is picked more often, the eye is the most sensitive there.
+func sampleWavelengths(u float64) *wavelengths {
+	wl := &wavelengths{}
+	for i := range wl.lambda {
+		up := u + float64(i)/numWavelengths
+		if up > 1.0 {
+			up -= 1.0
+		}
+
+		wl.lambda[i] = 538.0 - 138.888889*math.Atanh(0.85691062-1.82750197*up)
+		wl.pdf[i] = 0.0039398042 / math.Pow(math.Cosh(0.0072*(wl.lambda[i]-538.0)), 2.0)
+	}
+	return wl
+}
+
+// Only keeps the hero wavelength, for when the path can't go the same way for all of them
+// anymore, like light splitting up in glass.
+func (wl *wavelengths) collapse() {
+	if wl.pdf[1] == 0.0 {
+		return
+	}
+
+	for i := 1; i < numWavelengths; i++ {
+		wl.pdf[i] = 0.0
+	}
+	// The hero now counts for all of them.
+	wl.pdf[0] /= numWavelengths
+}
+
+// The values of an RGB reflectance at the wavelengths.
+func (wl *wavelengths) fromRGB(c vec3) spectrum {
+	var s spectrum
+	for i, l := range wl.lambda {
+		s[i] = rgbToSpectrum(c, l)
+	}
+	return s
+}
+
+// Turns what the path found at the wavelengths back into linear RGB.
+func (wl *wavelengths) toRGB(s spectrum) vec3 {
+	xyz := vec3{}
+	for i, l := range wl.lambda {
+		if wl.pdf[i] == 0.0 {
+			continue
+		}
+		xyz = xyz.add(cmf(l).mulScalar(s[i] / wl.pdf[i]))
+	}
+	xyz = xyz.divScalar(numWavelengths)
+
+	return xyzToRGB(xyz).div(whiteRGB)
+}
+
+// Traces a camera ray in spectral mode and gives the linear RGB of what it sees.
+func (r *ray) spectralColor(s *scene, rnd sampler) vec3 {
+	r.wl = sampleWavelengths(rnd.get1D())
+	return r.wl.toRGB(r.radiance(s, 0, rnd))
+}
+
+// The same as color, but for every wavelength of the path. Colors of textures and the sky are turned into spectra.
+func (r *ray) radiance(s *scene, depth int64, rnd sampler) spectrum {
+	rnd.startBounce(int(depth))
+
+	hr := hitRecord{}
+	if s.hit(*r, 0.001, math.MaxFloat64, &hr) {
+		hr.differentials(*r)
+		hr.mat.perturb(&hr)
+
+		scattered := ray{}
+		attenuation := vec3{}
+		if depth < 50 && hr.mat.scatter(*r, &hr, &attenuation, &scattered, rnd) {
+			scattered.wl = r.wl
+			return r.wl.fromRGB(attenuation).mul(scattered.radiance(s, depth+1, rnd))
+		}
+		return spectrum{}
+	}
+
+	return r.wl.fromRGB(sky(r.dir))
+}
+
+// Smits' spectra for turning RGB into a spectrum, in 10 bins from 380 to 720 nm.
+// Every color is made of white plus one of the secondary colors plus one of the primaries.
+var (
+	smitsWhite   = [10]float64{1.0000, 1.0000, 0.9999, 0.9993, 0.9992, 0.9998, 1.0000, 1.0000, 1.0000, 1.0000}
+	smitsCyan    = [10]float64{0.9710, 0.9426, 1.0007, 1.0007, 1.0007, 1.0007, 0.1564, 0.0000, 0.0000, 0.0000}
+	smitsMagenta = [10]float64{1.0000, 1.0000, 0.9685, 0.2229, 0.0000, 0.0458, 0.8369, 1.0000, 1.0000, 0.9959}
+	smitsYellow  = [10]float64{0.0001, 0.0000, 0.1088, 0.6651, 1.0000, 1.0000, 0.9996, 0.9586, 0.9685, 0.9840}
+	smitsRed     = [10]float64{0.1012, 0.0515, 0.0000, 0.0000, 0.0000, 0.0000, 0.8325, 1.0149, 1.0149, 1.0149}
+	smitsGreen   = [10]float64{0.0000, 0.0000, 0.0273, 0.7937, 1.0000, 0.9418, 0.1719, 0.0000, 0.0000, 0.0025}
+	smitsBlue    = [10]float64{1.0000, 1.0000, 0.8916, 0.3323, 0.0000, 0.0000, 0.0003, 0.0369, 0.0483, 0.0496}
+)
+
+// The value of the spectrum of c at wavelength l in nm.
+func rgbToSpectrum(c vec3, l float64) float64 {
+	at := func(bins *[10]float64) float64 {
+		// Interpolate between the middles of the bins, outside of them it's the first or last one.
+		x := (l-380.0)/34.0 - 0.5
+		if x <= 0.0 {
+			return bins[0]
+		}
+		if x >= 9.0 {
+			return bins[9]
+		}
+		i := int(x)
+		return lerp(bins[i], bins[i+1], x-float64(i))
+	}
+
+	r, g, b := c.x, c.y, c.z
+	if r <= g && r <= b {
+		s := r * at(&smitsWhite)
+		if g <= b {
+			return s + (g-r)*at(&smitsCyan) + (b-g)*at(&smitsBlue)
+		}
+		return s + (b-r)*at(&smitsCyan) + (g-b)*at(&smitsGreen)
+	}
+	if g <= r && g <= b {
+		s := g * at(&smitsWhite)
+		if r <= b {
+			return s + (r-g)*at(&smitsMagenta) + (b-r)*at(&smitsBlue)
+		}
+		return s + (b-g)*at(&smitsMagenta) + (r-b)*at(&smitsRed)
+	}
+
+	s := b * at(&smitsWhite)
+	if r <= g {
+		return s + (r-b)*at(&smitsYellow) + (g-r)*at(&smitsGreen)
+	}
+	return s + (g-b)*at(&smitsYellow) + (r-g)*at(&smitsRed)
+}
+
+// The CIE 1931 color matching functions, Wyman, Sloan and Shirley's fit with a few Gaussians.
+func cmf(l float64) vec3 {
+	g := func(mu, s1, s2 float64) float64 {
+		s := s2
+		if l < mu {
+			s = s1
+		}
+		t := (l - mu) / s
+		return math.Exp(-0.5 * t * t)
+	}
+
+	return vec(
+		1.056*g(599.8, 37.9, 31.0)+0.362*g(442.0, 16.0, 26.7)-0.065*g(501.1, 20.4, 26.2),
+		0.821*g(568.8, 46.9, 40.5)+0.286*g(530.9, 16.3, 31.1),
+		1.217*g(437.0, 11.8, 36.0)+0.681*g(459.0, 26.0, 13.8),
+	)
+}
+
+// To linear sRGB.
+func xyzToRGB(c vec3) vec3 {
+	return vec(
+		3.2404542*c.x-1.5371385*c.y-0.4985314*c.z,
+		-0.9692660*c.x+1.8760108*c.y+0.0415560*c.z,
+		0.0556434*c.x-0.2040259*c.y+1.0572252*c.z,
+	)
+}
+
+// What a spectrum that's 1 everywhere turns into, we divide by it so white stays white.
+var whiteRGB = func() vec3 {
+	xyz := vec3{}
+	for l := 360.0; l <= 830.0; l++ {
+		xyz = xyz.add(cmf(l))
+	}
+	return xyzToRGB(xyz)
+}()
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// The average RGB of c over n paths, with the wavelengths spread evenly. With hero only the first wavelength counts.
+func averageRGB(c vec3, n int, hero bool) vec3 {
+	sum := vec3{}
+	for i := 0; i < n; i++ {
+		wl := sampleWavelengths((float64(i) + 0.5) / float64(n))
+		if hero {
+			wl.collapse()
+		}
+		sum = sum.add(wl.toRGB(wl.fromRGB(c)))
+	}
+	return sum.divScalar(float64(n))
+}
+
+func TestSpectralWhite(t *testing.T) {
+	if got := averageRGB(vec(1.0, 1.0, 1.0), 4096, false); got.sub(vec(1.0, 1.0, 1.0)).length() > 0.01 {
+		t.Errorf("white comes back as %v", got)
+	}
+
+	// The wavelengths stay in the visible spectrum, give or take rounding.
+	for i := 0; i < 100; i++ {
+		wl := sampleWavelengths(float64(i) / 100.0)
+		for k, l := range wl.lambda {
+			if l < 360.0-1e-3 || l > 830.0+1e-3 || wl.pdf[k] <= 0.0 {
+				t.Fatalf("wavelength %v with pdf %v", l, wl.pdf[k])
+			}
+		}
+	}
+}
+
+func TestSpectralColors(t *testing.T) {
+	// Smits' spectra don't come back exactly, but close enough to see the color.
+	for _, c := range []vec3{vec(0.8, 0.3, 0.1), vec(0.1, 0.6, 0.2), vec(0.2, 0.3, 0.9), vec(0.5, 0.5, 0.5)} {
+		if got := averageRGB(c, 4096, false); got.sub(c).length() > 0.1 {
+			t.Errorf("%v comes back as %v", c, got)
+		}
+	}
+}
+
+// Keeping only the hero is noisier, but on average it has to give the same color.
+func TestSpectralCollapse(t *testing.T) {
+	for _, c := range []vec3{vec(1.0, 1.0, 1.0), vec(0.8, 0.3, 0.1), vec(0.2, 0.3, 0.9)} {
+		all := averageRGB(c, 8192, false)
+		hero := averageRGB(c, 8192, true)
+		if hero.sub(all).length() > 0.01 {
+			t.Errorf("%v is %v with all wavelengths and %v with the hero", c, all, hero)
+		}
+	}
+
+	wl := sampleWavelengths(0.3)
+	pdf := wl.pdf[0]
+	wl.collapse()
+	wl.collapse()
+	if wl.pdf[0] != pdf/numWavelengths || wl.pdf[1] != 0.0 {
+		t.Errorf("collapsing twice gave pdfs %v", wl.pdf)
+	}
+}
+
+// The indices at 589.3 nm, like they're listed.
+func TestIndexAt(t *testing.T) {
+	cases := []struct {
+		name string
+		m    *material
+		want float64
+	}{
+		{"crown glass", cauchyGlass(1.5046, 0.0042, 0.0), 1.5168},
+		{"flint glass", flintGlass(), 1.7847},
+		{"diamond", diamond(), 2.4175},
+		{"plain glass", glass(1.5), 1.5},
+	}
+	for _, c := range cases {
+		if got := c.m.indexAt(589.3); math.Abs(got-c.want) > 1e-3 {
+			t.Errorf("%s has index %v, want %v", c.name, got, c.want)
+		}
+		if c.m.refIndex != c.m.indexAt(589.3) {
+			t.Errorf("%s has refIndex %v", c.name, c.m.refIndex)
+		}
+	}
+
+	// Blue bends more than red.
+	for _, m := range []*material{cauchyGlass(1.5046, 0.0042, 0.0), flintGlass(), diamond()} {
+		if m.indexAt(450.0) <= m.indexAt(650.0) {
+			t.Errorf("index at 450 nm is %v and at 650 nm %v", m.indexAt(450.0), m.indexAt(650.0))
+		}
+	}
+}
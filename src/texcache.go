@@ -0,0 +1,436 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Textures are cut into square tiles of this many pixels, the cache keeps and throws away whole tiles.
+const tileSize = 32
+
+// All image textures go through this, so every file is only loaded once.
+var textures = newTextureCache()
+
+// Keeps the pixels of the image textures. Files are only read when a pixel of them is needed,
+// and with a memory limit the tiles that weren't used for the longest time are thrown away.
+// Looking up a tile that's in memory doesn't lock anything, so the render goroutines don't wait on each other.
+type textureCache struct {
+	mu       sync.Mutex   // For the map and for throwing tiles away.
+	maxBytes atomic.Int64 // Zero means there's no limit.
+	used     atomic.Int64
+	clock    atomic.Int64 // Goes up every time a file is read, tiles remember the time they were last used.
+	images   map[texKey]*texImage
+}
+
+// The same file as sRGB and as data are two images, their smaller levels are different.
+type texKey struct {
+	path string
+	srgb bool
+}
+
+func newTextureCache() *textureCache {
+	return &textureCache{images: map[texKey]*texImage{}}
+}
+
+// Sets the memory limit in bytes, zero for no limit.
+func (c *textureCache) setLimit(bytes int64) {
+	c.maxBytes.Store(bytes)
+	c.evict(nil)
+}
+
+// A texture file with all its mip levels, the tiles can be in memory or not.
+type texImage struct {
+	path  string
+	srgb  bool     // The smaller levels are made in linear space and kept as floats, the first one is made linear when it's used.
+	sizes [][2]int // Width and height of every level, the first one is the full image.
+	tiles [][]atomic.Pointer[texTile]
+	cache *textureCache
+
+	// Only one goroutine reads the file at a time, the others wait for it instead of reading it too.
+	mu    sync.Mutex
+	reads int // How many times the file was read.
+}
+
+type texTile struct {
+	pix8     []uint8   // RGBA, for 8-bit images.
+	pixF     []float32 // RGBA, for the others.
+	lastUsed atomic.Int64
+
+	img          *texImage
+	level, index int
+}
+
+// How far t is from o, in pixels of the full image. Zero when they overlap, so the smaller
+// levels over o count as close. Tiles of other images are infinitely far away.
+func (t *texTile) distance(o *texTile) float64 {
+	if o == nil || t.img != o.img {
+		return math.Inf(1)
+	}
+
+	center := func(t *texTile) (float64, float64, float64) {
+		scale := math.Ldexp(tileSize, t.level)
+		n := tilesAcross(t.img.sizes[t.level][0])
+		return (float64(t.index%n) + 0.5) * scale, (float64(t.index/n) + 0.5) * scale, scale / 2.0
+	}
+	x0, y0, r0 := center(t)
+	x1, y1, r1 := center(o)
+	return math.Max(0.0, math.Hypot(x1-x0, y1-y0)-r0-r1)
+}
+
+func (t *texTile) bytes() int64 {
+	return int64(len(t.pix8) + 4*len(t.pixF))
+}
+
+// Returns the texture of a file, it's the same one every time for the same file and color space. Only the size is read now.
+func (c *textureCache) get(name string, srgb bool) *texImage {
+	name, err := filepath.Abs(name)
+	check(err)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if img, ok := c.images[texKey{name, srgb}]; ok {
+		return img
+	}
+
+	size := readTexture(name, true)
+
+	img := &texImage{path: name, srgb: srgb, cache: c}
+	w, h := size.w, size.h
+	for {
+		img.sizes = append(img.sizes, [2]int{w, h})
+		img.tiles = append(img.tiles, make([]atomic.Pointer[texTile], tilesAcross(w)*tilesAcross(h)))
+		if w == 1 && h == 1 {
+			break
+		}
+		w, h = (w+1)/2, (h+1)/2
+	}
+
+	c.images[texKey{name, srgb}] = img
+	return img
+}
+
+func tilesAcross(n int) int {
+	return (n + tileSize - 1) / tileSize
+}
+
+func (img *texImage) levels() int {
+	return len(img.sizes)
+}
+
+func (img *texImage) size(level int) (int, int) {
+	return img.sizes[level][0], img.sizes[level][1]
+}
+
+// The color of pixel x, y of a level, it has to be inside the image. It's always linear.
+func (img *texImage) texel(level, x, y int) vec3 {
+	t := img.tile(level, x/tileSize, y/tileSize)
+	i := 4 * ((y%tileSize)*tileSize + x%tileSize)
+
+	// The smaller levels of sRGB images are already linear.
+	srgb := img.srgb && level == 0
+
+	if t.pix8 != nil {
+		if srgb {
+			return vec(srgbTable[t.pix8[i]], srgbTable[t.pix8[i+1]], srgbTable[t.pix8[i+2]])
+		}
+		return vec(float64(t.pix8[i])/255.0, float64(t.pix8[i+1])/255.0, float64(t.pix8[i+2])/255.0)
+	}
+
+	c := vec(float64(t.pixF[i]), float64(t.pixF[i+1]), float64(t.pixF[i+2]))
+	if srgb {
+		return vec(srgbToLinear(c.x), srgbToLinear(c.y), srgbToLinear(c.z))
+	}
+	return c
+}
+
+// Every 8-bit sRGB value made linear, so we don't need a pow for every pixel.
+var srgbTable = func() [256]float64 {
+	var t [256]float64
+	for i := range t {
+		t[i] = srgbToLinear(float64(i) / 255.0)
+	}
+	return t
+}()
+
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func (img *texImage) tile(level, tx, ty int) *texTile {
+	index := ty*tilesAcross(img.sizes[level][0]) + tx
+
+	t := img.tiles[level][index].Load()
+	if t == nil {
+		t = img.load(level, index)
+	}
+
+	// Only write when it changed, most lookups are in tiles that were used a moment ago.
+	if now := img.cache.clock.Load(); t.lastUsed.Load() != now {
+		t.lastUsed.Store(now)
+	}
+	return t
+}
+
+// Reads the file and makes the tile we wanted, only this image is locked while the file is read. The other
+// textures and the tiles of this one that are in memory can still be used.
+//
+// Without a limit every tile of every level is kept, so the file is only read once. With one only the tiles
+// around the one we wanted are kept, of its level and the levels next to it, and only as many as fit. The whole
+// file and the levels down to that one are still in memory for a moment while they're made, formats like PNG
+// can't be read a part at a time.
+func (img *texImage) load(level, index int) *texTile {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	// Someone else may have read it while we waited.
+	if t := img.tiles[level][index].Load(); t != nil {
+		return t
+	}
+
+	c := img.cache
+	now := c.clock.Add(1)
+	lvl := readTexture(img.path, false)
+	img.reads++
+
+	max := c.maxBytes.Load()
+	last := img.levels() - 1
+	if max > 0 && level+1 < last {
+		last = level + 1
+	}
+
+	// The other tiles we could keep, they're made when there's room for them.
+	type extra struct {
+		lvl      *texLevel
+		at       *texTile
+		distance float64
+	}
+	var want *texTile
+	var extras []extra
+	for l := 0; l <= last; l++ {
+		if l > 0 {
+			// Averaging has to happen in linear space, otherwise sRGB textures get darker in the distance.
+			if l == 1 && img.srgb {
+				lvl = lvl.linear()
+			}
+			lvl = lvl.half()
+		}
+		if max > 0 && l < level-1 {
+			continue
+		}
+
+		for i := range img.tiles[l] {
+			if img.tiles[l][i].Load() != nil {
+				continue
+			}
+			if l == level && i == index {
+				want = img.cut(lvl, l, i)
+				want.lastUsed.Store(now)
+				continue
+			}
+			extras = append(extras, extra{lvl: lvl, at: &texTile{img: img, level: l, index: i}})
+		}
+	}
+
+	img.tiles[level][index].Store(want)
+	if used := c.used.Add(want.bytes()); max > 0 && used > max {
+		c.evict(want)
+	}
+
+	// We've got them anyway, but nobody asked for them yet, so they're the first to go when there's no room.
+	// The ones closest to the tile we wanted are kept first, they're probably next. Nothing is thrown away for them.
+	for i := range extras {
+		extras[i].distance = extras[i].at.distance(want)
+	}
+	sort.SliceStable(extras, func(i, j int) bool {
+		return extras[i].distance < extras[j].distance
+	})
+	for _, e := range extras {
+		t := img.cut(e.lvl, e.at.level, e.at.index)
+		if max > 0 && c.used.Load()+t.bytes() > max {
+			break
+		}
+		img.tiles[e.at.level][e.at.index].Store(t)
+		c.used.Add(t.bytes())
+	}
+
+	return want
+}
+
+// Copies tile i of level l out of lvl.
+func (img *texImage) cut(lvl *texLevel, l, i int) *texTile {
+	t := lvl.tile(i%tilesAcross(lvl.w), i/tilesAcross(lvl.w))
+	t.img, t.level, t.index = img, l, i
+	return t
+}
+
+// Throws away the least recently used tiles until we're a bit under the limit, so the next tile
+// doesn't have to do this again. Keep is never thrown away. A tile that's thrown away can still
+// be in use by whoever looked it up, it just can't be found anymore.
+func (c *textureCache) evict(keep *texTile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	max := c.maxBytes.Load()
+	if max == 0 || c.used.Load() <= max {
+		return
+	}
+
+	type inMemory struct {
+		slot     *atomic.Pointer[texTile]
+		tile     *texTile
+		used     int64
+		distance float64
+	}
+	var tiles []inMemory
+	for _, img := range c.images {
+		for l := range img.tiles {
+			for i := range img.tiles[l] {
+				slot := &img.tiles[l][i]
+				if t := slot.Load(); t != nil && t != keep {
+					tiles = append(tiles, inMemory{slot, t, t.lastUsed.Load(), t.distance(keep)})
+				}
+			}
+		}
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].used != tiles[j].used {
+			return tiles[i].used < tiles[j].used
+		}
+		return tiles[i].distance > tiles[j].distance
+	})
+
+	target := max - max/8
+	for _, t := range tiles {
+		if c.used.Load() <= target {
+			break
+		}
+		if t.slot.CompareAndSwap(t.tile, nil) {
+			c.used.Add(-t.tile.bytes())
+		}
+	}
+}
+
+// A whole level of a texture while it's being loaded.
+type texLevel struct {
+	w, h int
+	pix8 []uint8
+	pixF []float32
+}
+
+// Converts a decoded image, images with more than 8 bits per channel are kept as floats.
+func newTexLevel(img image.Image) *texLevel {
+	b := img.Bounds()
+	l := &texLevel{w: b.Dx(), h: b.Dy()}
+
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		l.pixF = make([]float32, 4*l.w*l.h)
+		for y := 0; y < l.h; y++ {
+			for x := 0; x < l.w; x++ {
+				r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				i := 4 * (y*l.w + x)
+				l.pixF[i] = float32(r) / 65535.0
+				l.pixF[i+1] = float32(g) / 65535.0
+				l.pixF[i+2] = float32(bl) / 65535.0
+				l.pixF[i+3] = float32(a) / 65535.0
+			}
+		}
+	default:
+		rgba := image.NewRGBA(image.Rect(0, 0, l.w, l.h))
+		draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+		l.pix8 = rgba.Pix
+	}
+
+	return l
+}
+
+// A float copy of an sRGB level with linear colors, alpha stays the same.
+func (l *texLevel) linear() *texLevel {
+	f := &texLevel{w: l.w, h: l.h, pixF: make([]float32, 4*l.w*l.h)}
+	for i := range f.pixF {
+		switch {
+		case i%4 == 3 && l.pix8 != nil:
+			f.pixF[i] = float32(l.pix8[i]) / 255.0
+		case i%4 == 3:
+			f.pixF[i] = l.pixF[i]
+		case l.pix8 != nil:
+			f.pixF[i] = float32(srgbTable[l.pix8[i]])
+		default:
+			f.pixF[i] = float32(srgbToLinear(float64(l.pixF[i])))
+		}
+	}
+	return f
+}
+
+// Half the size, every pixel is the average of the (up to) four below it.
+func (l *texLevel) half() *texLevel {
+	h := &texLevel{w: (l.w + 1) / 2, h: (l.h + 1) / 2}
+	if l.pix8 != nil {
+		h.pix8 = make([]uint8, 4*h.w*h.h)
+	} else {
+		h.pixF = make([]float32, 4*h.w*h.h)
+	}
+
+	for j := 0; j < h.h; j++ {
+		for i := 0; i < h.w; i++ {
+			for c := 0; c < 4; c++ {
+				var sum8 int
+				var sumF float32
+				n := 0
+				for y := 2 * j; y < 2*j+2 && y < l.h; y++ {
+					for x := 2 * i; x < 2*i+2 && x < l.w; x++ {
+						k := 4*(y*l.w+x) + c
+						if l.pix8 != nil {
+							sum8 += int(l.pix8[k])
+						} else {
+							sumF += l.pixF[k]
+						}
+						n++
+					}
+				}
+
+				k := 4*(j*h.w+i) + c
+				if h.pix8 != nil {
+					h.pix8[k] = uint8((sum8 + n/2) / n)
+				} else {
+					h.pixF[k] = sumF / float32(n)
+				}
+			}
+		}
+	}
+
+	return h
+}
+
+// Copies a tile out of the level, tiles on the edge are padded with zeros.
+func (l *texLevel) tile(tx, ty int) *texTile {
+	t := &texTile{}
+	if l.pix8 != nil {
+		t.pix8 = make([]uint8, 4*tileSize*tileSize)
+	} else {
+		t.pixF = make([]float32, 4*tileSize*tileSize)
+	}
+
+	for y := 0; y < tileSize && ty*tileSize+y < l.h; y++ {
+		for x := 0; x < tileSize && tx*tileSize+x < l.w; x++ {
+			src := 4 * ((ty*tileSize+y)*l.w + tx*tileSize + x)
+			dst := 4 * (y*tileSize + x)
+			if l.pix8 != nil {
+				copy(t.pix8[dst:dst+4], l.pix8[src:src+4])
+			} else {
+				copy(t.pixF[dst:dst+4], l.pixF[src:src+4])
+			}
+		}
+	}
+
+	return t
+}
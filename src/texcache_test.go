@@ -0,0 +1,163 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Writes a 256x256 PNG where every pixel says where it is, red is x and green is y.
+func writeTestTexture(t *testing.T) string {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	return writePNG(t, "coords.png", img)
+}
+
+func writePNG(t *testing.T, name string, img image.Image) string {
+	t.Helper()
+
+	name = filepath.Join(t.TempDir(), name)
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func checkTexel(t *testing.T, img *texImage, x, y int) {
+	c := img.texel(0, x, y)
+	if int(c.x*255.0+0.5) != x || int(c.y*255.0+0.5) != y {
+		t.Errorf("pixel %d, %d is %v", x, y, c)
+	}
+}
+
+// A texture that doesn't fit in memory keeps the tiles that are used, instead of reading the file for every lookup.
+func TestTextureCacheKeepsUsedTiles(t *testing.T) {
+	c := newTextureCache()
+	// 90 tiles of 4 KB on all levels, there's only room for 16.
+	c.setLimit(16 * 4096)
+	img := c.get(writeTestTexture(t), false)
+
+	for i := 0; i < 100; i++ {
+		for y := 0; y < 64; y += 7 {
+			for x := 0; x < 64; x += 5 {
+				checkTexel(t, img, x, y)
+			}
+		}
+	}
+
+	if img.reads != 1 {
+		t.Errorf("the file was read %d times for 4 tiles that fit in memory", img.reads)
+	}
+	if c.used.Load() > 16*4096 {
+		t.Errorf("%d bytes in memory, the limit is %d", c.used.Load(), 16*4096)
+	}
+
+	// Going somewhere else reads it again, and the tiles still have the right pixels.
+	checkTexel(t, img, 200, 200)
+	checkTexel(t, img, 10, 10)
+	if img.reads != 2 {
+		t.Errorf("the file was read %d times, want 2", img.reads)
+	}
+}
+
+// With a limit a read only keeps what fits, of the level that was used and the ones next to it.
+func TestTextureCacheKeepsNearbyTiles(t *testing.T) {
+	c := newTextureCache()
+	c.setLimit(10 * 4096)
+	img := c.get(writeTestTexture(t), false)
+	checkTexel(t, img, 100, 100)
+
+	inMemory := 0
+	for l := range img.tiles {
+		for i := range img.tiles[l] {
+			if tile := img.tiles[l][i].Load(); tile != nil {
+				inMemory++
+				if l > 1 {
+					t.Errorf("tile %d of level %d is in memory, only levels 0 and 1 were needed", i, l)
+				}
+				if d := tile.distance(img.tiles[0][3*8+3].Load()); d > 64.0 {
+					t.Errorf("tile %d of level %d is %v pixels away", i, l, d)
+				}
+			}
+		}
+	}
+	if inMemory != 10 {
+		t.Errorf("%d tiles are in memory, 10 fit", inMemory)
+	}
+
+	// When it's full the next read only keeps the tile that was asked for.
+	checkTexel(t, img, 250, 10)
+	if c.used.Load() > 10*4096 {
+		t.Errorf("%d bytes in memory, the limit is %d", c.used.Load(), 10*4096)
+	}
+}
+
+func TestTextureCacheConcurrent(t *testing.T) {
+	c := newTextureCache()
+	c.setLimit(6 * 4096)
+	img := c.get(writeTestTexture(t), false)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				checkTexel(t, img, (g*37+i*13)%256, (g*71+i*29)%256)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if c.used.Load() > 6*4096 {
+		t.Errorf("%d bytes in memory, the limit is %d", c.used.Load(), 6*4096)
+	}
+}
+
+// A black and white checker is half as bright from far away, also when it's sRGB.
+func TestSRGBMipLevels(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := uint8(0)
+			if (x+y)%2 == 0 {
+				c = 255
+			}
+			img.Set(x, y, color.NRGBA{c, c, c, 255})
+		}
+	}
+	name := writePNG(t, "checker.png", img)
+
+	c := newTextureCache()
+	srgb := c.get(name, true)
+	if c.get(name, false) == srgb || c.get(name, true) != srgb {
+		t.Error("the color space should be part of the key")
+	}
+
+	if got := srgb.texel(0, 0, 0); got != vec(1.0, 1.0, 1.0) {
+		t.Errorf("white is %v", got)
+	}
+	if got := srgb.texel(0, 1, 0); got != vec(0.0, 0.0, 0.0) {
+		t.Errorf("black is %v", got)
+	}
+	for l := 1; l < srgb.levels(); l++ {
+		if got := srgb.texel(l, 0, 0); !vecNear(got, vec(0.5, 0.5, 0.5)) {
+			t.Errorf("level %d is %v, want 0.5", l, got)
+		}
+	}
+}
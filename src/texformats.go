@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+)
+
+// Formats image.Decode doesn't know, by extension. With headerOnly they only read the size.
+// HDR, PFM and EXR are floats, so they can be brighter than white.
+var texFormats = map[string]func(r *bufio.Reader, headerOnly bool) (*texLevel, error){
+	".hdr": decodeHDR,
+	".pfm": decodePFM,
+	".exr": decodeEXR,
+	".tga": decodeTGA,
+}
+
+// Reads a texture file, all of it or just the size.
+func readTexture(name string, headerOnly bool) *texLevel {
+	file, err := os.Open(name)
+	check(err)
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	if decode, ok := texFormats[strings.ToLower(filepath.Ext(name))]; ok {
+		lvl, err := decode(r, headerOnly)
+		if err != nil {
+			panic(fmt.Errorf("%s: %v", name, err))
+		}
+		return lvl
+	}
+
+	if headerOnly {
+		cfg, _, err := image.DecodeConfig(r)
+		check(err)
+		return &texLevel{w: cfg.Width, h: cfg.Height}
+	}
+
+	img, _, err := image.Decode(r)
+	check(err)
+	return newTexLevel(img)
+}
+
+// A float level, alpha is one everywhere.
+func newFloatLevel(w, h int) *texLevel {
+	l := &texLevel{w: w, h: h, pixF: make([]float32, 4*w*h)}
+	for i := 3; i < len(l.pixF); i += 4 {
+		l.pixF[i] = 1.0
+	}
+	return l
+}
+
+// Radiance HDR, every pixel is 8 bits of red, green and blue with a shared exponent.
+func decodeHDR(r *bufio.Reader, headerOnly bool) (*texLevel, error) {
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "#?") {
+		return nil, fmt.Errorf("not a radiance file")
+	}
+
+	// The header ends with an empty line, the size comes after that.
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("unsupported format %s", line)
+		}
+	}
+
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	var w, h int
+	if _, err := fmt.Sscanf(line, "-Y %d +X %d", &h, &w); err != nil {
+		return nil, fmt.Errorf("unsupported orientation %q", strings.TrimSpace(line))
+	}
+	if headerOnly {
+		return &texLevel{w: w, h: h}, nil
+	}
+
+	l := newFloatLevel(w, h)
+	scan := make([]byte, 4*w)
+	for y := 0; y < h; y++ {
+		if err := readRGBEScanline(r, scan, w); err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < w; x++ {
+			e := scan[4*x+3]
+			if e == 0 {
+				continue
+			}
+			f := math.Ldexp(1.0, int(e)-136)
+			i := 4 * (y*w + x)
+			l.pixF[i] = float32(float64(scan[4*x]) * f)
+			l.pixF[i+1] = float32(float64(scan[4*x+1]) * f)
+			l.pixF[i+2] = float32(float64(scan[4*x+2]) * f)
+		}
+	}
+
+	return l, nil
+}
+
+// Scanlines are either plain pixels, or the four components one after the other, run length encoded.
+func readRGBEScanline(r *bufio.Reader, scan []byte, w int) error {
+	start := make([]byte, 4)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return err
+	}
+
+	if w < 8 || w > 0x7fff || start[0] != 2 || start[1] != 2 || start[2]&0x80 != 0 {
+		copy(scan, start)
+		_, err := io.ReadFull(r, scan[4:])
+		return err
+	}
+	if int(start[2])<<8|int(start[3]) != w {
+		return fmt.Errorf("wrong scanline width")
+	}
+
+	for c := 0; c < 4; c++ {
+		for x := 0; x < w; {
+			count, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+
+			if count > 128 {
+				// A run of the same value.
+				n := int(count) - 128
+				v, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+n > w {
+					return fmt.Errorf("run past the end of the scanline")
+				}
+				for ; n > 0; n-- {
+					scan[4*x+c] = v
+					x++
+				}
+			} else {
+				n := int(count)
+				if n == 0 || x+n > w {
+					return fmt.Errorf("bad run in scanline")
+				}
+				for ; n > 0; n-- {
+					v, err := r.ReadByte()
+					if err != nil {
+						return err
+					}
+					scan[4*x+c] = v
+					x++
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Portable float map, "PF" for color and "Pf" for gray. A negative scale means little endian, the rows go up.
+func decodePFM(r *bufio.Reader, headerOnly bool) (*texLevel, error) {
+	var kind string
+	var w, h int
+	var scale float64
+	if _, err := fmt.Fscan(r, &kind, &w, &h, &scale); err != nil {
+		return nil, err
+	}
+	if kind != "PF" && kind != "Pf" {
+		return nil, fmt.Errorf("not a portable float map")
+	}
+	if headerOnly {
+		return &texLevel{w: w, h: h}, nil
+	}
+
+	// A single whitespace character after the scale, then the data.
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	channels := 3
+	if kind == "Pf" {
+		channels = 1
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if scale < 0.0 {
+		order = binary.LittleEndian
+	}
+
+	l := newFloatLevel(w, h)
+	buf := make([]byte, 4*channels*w)
+	for row := 0; row < h; row++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		y := h - 1 - row
+		for x := 0; x < w; x++ {
+			i := 4 * (y*w + x)
+			for c := 0; c < 3; c++ {
+				k := x*channels + c%channels
+				l.pixF[i+c] = math.Float32frombits(order.Uint32(buf[4*k:]))
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// OpenEXR compression types.
+const (
+	exrNone = 0
+	exrRLE  = 1
+	exrZIPS = 2 // Zip, one scanline at a time.
+	exrZIP  = 3 // Zip, 16 scanlines at a time.
+)
+
+// Gray images have a Y channel, it goes to all three colors.
+const exrGray = 4
+
+type exrChannel struct {
+	name      string
+	pixelType uint32 // 0 uint, 1 half, 2 float.
+}
+
+// OpenEXR scanline images without compression, or with RLE or zip. Tiled images aren't supported.
+func decodeEXR(r *bufio.Reader, headerOnly bool) (*texLevel, error) {
+	var magic, version uint32
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if magic != 20000630 {
+		return nil, fmt.Errorf("not an OpenEXR file")
+	}
+	if version&0x200 != 0 {
+		return nil, fmt.Errorf("tiled OpenEXR files aren't supported")
+	}
+
+	// The header is a list of attributes, it ends with an empty name.
+	var channels []exrChannel
+	compression := -1
+	var xMin, yMin, xMax, yMax int32
+	for {
+		name, err := r.ReadString(0)
+		if err != nil {
+			return nil, err
+		}
+		name = strings.TrimSuffix(name, "\x00")
+		if name == "" {
+			break
+		}
+		if _, err := r.ReadString(0); err != nil {
+			return nil, err
+		}
+		var size int32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "channels":
+			for len(value) > 1 {
+				end := bytes.IndexByte(value, 0)
+				if end < 0 || len(value) < end+17 {
+					return nil, fmt.Errorf("bad channel list")
+				}
+				channels = append(channels, exrChannel{string(value[:end]), binary.LittleEndian.Uint32(value[end+1:])})
+				value = value[end+17:]
+			}
+		case "compression":
+			compression = int(value[0])
+		case "dataWindow":
+			xMin = int32(binary.LittleEndian.Uint32(value[0:]))
+			yMin = int32(binary.LittleEndian.Uint32(value[4:]))
+			xMax = int32(binary.LittleEndian.Uint32(value[8:]))
+			yMax = int32(binary.LittleEndian.Uint32(value[12:]))
+		}
+	}
+
+	w, h := int(xMax-xMin+1), int(yMax-yMin+1)
+	if headerOnly {
+		return &texLevel{w: w, h: h}, nil
+	}
+
+	linesPerChunk := 1
+	switch compression {
+	case exrNone, exrRLE, exrZIPS:
+	case exrZIP:
+		linesPerChunk = 16
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", compression)
+	}
+
+	// Where every channel ends up, gray images only have Y. Other channels are skipped.
+	target := make([]int, len(channels))
+	lineBytes := 0
+	for i, ch := range channels {
+		switch ch.name[strings.LastIndex(ch.name, ".")+1:] {
+		case "R":
+			target[i] = 0
+		case "G":
+			target[i] = 1
+		case "B":
+			target[i] = 2
+		case "A":
+			target[i] = 3
+		case "Y":
+			target[i] = exrGray
+		default:
+			target[i] = -1
+		}
+
+		if ch.pixelType == 1 {
+			lineBytes += 2 * w
+		} else {
+			lineBytes += 4 * w
+		}
+	}
+
+	// We read the chunks in order, so the offsets aren't needed.
+	chunks := (h + linesPerChunk - 1) / linesPerChunk
+	if _, err := r.Discard(8 * chunks); err != nil {
+		return nil, err
+	}
+
+	l := newFloatLevel(w, h)
+	for c := 0; c < chunks; c++ {
+		var y, size int32
+		if err := binary.Read(r, binary.LittleEndian, &y); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		packed := make([]byte, size)
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return nil, err
+		}
+
+		lines := linesPerChunk
+		if int(y-yMin)+lines > h {
+			lines = h - int(y-yMin)
+		}
+		data, err := exrDecompress(packed, compression, lines*lineBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		for line := 0; line < lines; line++ {
+			row := int(y-yMin) + line
+			for i, ch := range channels {
+				for x := 0; x < w; x++ {
+					var v float32
+					switch ch.pixelType {
+					case 0:
+						v = float32(binary.LittleEndian.Uint32(data))
+						data = data[4:]
+					case 1:
+						v = halfToFloat(binary.LittleEndian.Uint16(data))
+						data = data[2:]
+					default:
+						v = math.Float32frombits(binary.LittleEndian.Uint32(data))
+						data = data[4:]
+					}
+
+					k := 4 * (row*w + x)
+					switch t := target[i]; t {
+					case -1:
+					case exrGray:
+						l.pixF[k], l.pixF[k+1], l.pixF[k+2] = v, v, v
+					default:
+						l.pixF[k+t] = v
+					}
+				}
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// Unpacks a chunk, when compressing didn't make it smaller it's stored as it is.
+func exrDecompress(packed []byte, compression, size int) ([]byte, error) {
+	if compression == exrNone || len(packed) == size {
+		return packed, nil
+	}
+
+	var data []byte
+	switch compression {
+	case exrRLE:
+		for i := 0; i < len(packed); {
+			n := int(int8(packed[i]))
+			i++
+			if n < 0 {
+				if i-n > len(packed) {
+					return nil, fmt.Errorf("bad run length data")
+				}
+				data = append(data, packed[i:i-n]...)
+				i -= n
+			} else {
+				if i >= len(packed) {
+					return nil, fmt.Errorf("bad run length data")
+				}
+				for ; n >= 0; n-- {
+					data = append(data, packed[i])
+				}
+				i++
+			}
+		}
+	default:
+		zr, err := zlib.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("chunk is %d bytes instead of %d", len(data), size)
+	}
+
+	// Every byte was stored as the difference with the one before it.
+	for i := 1; i < len(data); i++ {
+		data[i] = byte(int(data[i-1]) + int(data[i]) - 128)
+	}
+
+	// And the first half has the even bytes, the second half the odd ones.
+	out := make([]byte, size)
+	half := (size + 1) / 2
+	for i := 0; i < size; i++ {
+		if i%2 == 0 {
+			out[i] = data[i/2]
+		} else {
+			out[i] = data[half+i/2]
+		}
+	}
+
+	return out, nil
+}
+
+// 16-bit floats, with 5 bits of exponent and 10 of mantissa.
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+
+	switch {
+	case exp == 0 && mant == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// Denormal, it's just the mantissa times the smallest exponent.
+		f := float32(mant) / 1024.0 / 16384.0
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	default:
+		return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+	}
+}
+
+// Truevision TGA, with or without run length encoding, true color, gray or with a color map.
+func decodeTGA(r *bufio.Reader, headerOnly bool) (*texLevel, error) {
+	hdr := make([]byte, 18)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	idLength := int(hdr[0])
+	mapType := hdr[1]
+	imageType := hdr[2]
+	mapFirst := int(binary.LittleEndian.Uint16(hdr[3:]))
+	mapLength := int(binary.LittleEndian.Uint16(hdr[5:]))
+	mapDepth := int(hdr[7])
+	w := int(binary.LittleEndian.Uint16(hdr[12:]))
+	h := int(binary.LittleEndian.Uint16(hdr[14:]))
+	depth := int(hdr[16])
+	descriptor := hdr[17]
+
+	switch imageType {
+	case 1, 2, 3, 9, 10, 11:
+	default:
+		return nil, fmt.Errorf("unsupported TGA type %d", imageType)
+	}
+	if headerOnly {
+		return &texLevel{w: w, h: h}, nil
+	}
+
+	if _, err := r.Discard(idLength); err != nil {
+		return nil, err
+	}
+
+	var palette []color.NRGBA
+	if mapType == 1 {
+		palette = make([]color.NRGBA, mapLength)
+		buf := make([]byte, (mapDepth+7)/8)
+		for i := range palette {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			palette[i] = tgaColor(buf, mapDepth, false)
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	gray := imageType == 3 || imageType == 11
+	mapped := imageType == 1 || imageType == 9
+	rle := imageType >= 9
+	pixel := make([]byte, (depth+7)/8)
+
+	read := func() (color.NRGBA, error) {
+		if _, err := io.ReadFull(r, pixel); err != nil {
+			return color.NRGBA{}, err
+		}
+		if mapped {
+			i := int(pixel[0])
+			if len(pixel) > 1 {
+				i |= int(pixel[1]) << 8
+			}
+			i -= mapFirst
+			if i < 0 || i >= len(palette) {
+				return color.NRGBA{}, fmt.Errorf("color map index out of range")
+			}
+			return palette[i], nil
+		}
+		return tgaColor(pixel, depth, gray), nil
+	}
+
+	// By default the first row is the bottom one.
+	put := func(n int, c color.NRGBA) {
+		x, y := n%w, n/w
+		if descriptor&0x10 != 0 {
+			x = w - 1 - x
+		}
+		if descriptor&0x20 == 0 {
+			y = h - 1 - y
+		}
+		img.SetNRGBA(x, y, c)
+	}
+
+	for n := 0; n < w*h; {
+		count := 1
+		repeat := false
+		if rle {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			count = int(b&0x7f) + 1
+			repeat = b&0x80 != 0
+		}
+
+		var c color.NRGBA
+		for i := 0; i < count && n < w*h; i++ {
+			if i == 0 || !repeat {
+				var err error
+				if c, err = read(); err != nil {
+					return nil, err
+				}
+			}
+			put(n, c)
+			n++
+		}
+	}
+
+	return newTexLevel(img), nil
+}
+
+// Colors are stored as blue, green, red and alpha, 16-bit colors have 5 bits for every component.
+func tgaColor(b []byte, depth int, gray bool) color.NRGBA {
+	switch {
+	case gray:
+		a := uint8(255)
+		if len(b) > 1 {
+			a = b[1]
+		}
+		return color.NRGBA{b[0], b[0], b[0], a}
+	case depth == 15 || depth == 16:
+		v := int(b[0]) | int(b[1])<<8
+		expand := func(x int) uint8 { return uint8(x<<3 | x>>2) }
+		return color.NRGBA{expand(v >> 10 & 0x1f), expand(v >> 5 & 0x1f), expand(v & 0x1f), 255}
+	case depth == 32:
+		return color.NRGBA{b[2], b[1], b[0], b[3]}
+	default:
+		return color.NRGBA{b[2], b[1], b[0], 255}
+	}
+}
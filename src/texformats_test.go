@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestColorSpace(t *testing.T) {
+	cases := map[float64]float64{0.0: 0.0, 0.04: 0.04 / 12.92, 0.5: 0.21404114, 1.0: 1.0}
+	for c, want := range cases {
+		if got := srgbToLinear(c); math.Abs(got-want) > 1e-6 {
+			t.Errorf("srgbToLinear(%v) = %v, want %v", c, got, want)
+		}
+	}
+	for i, got := range srgbTable {
+		if want := srgbToLinear(float64(i) / 255.0); got != want {
+			t.Fatalf("srgbTable[%d] = %v, want %v", i, got, want)
+		}
+	}
+
+	// The same file, once as data and once as a color.
+	name := writeTestTexture(t)
+	linear := createImageTex(name)
+	srgb := createImageTex(name).colorSpace(colorSRGB)
+	for _, x := range []float64{0.0, 10.0, 128.0, 255.0} {
+		u, v := pixelUV(x, 0.0)
+		if got := linear.value(u, v, vec3{}).x; math.Abs(got-x/255.0) > 1e-9 {
+			t.Errorf("linear pixel %v is %v", x, got)
+		}
+		if got, want := srgb.value(u, v, vec3{}).x, srgbToLinear(x/255.0); math.Abs(got-want) > 1e-9 {
+			t.Errorf("sRGB pixel %v is %v, want %v", x, got, want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	name = filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func floatAt(l *texLevel, x, y int) vec3 {
+	i := 4 * (y*l.w + x)
+	return vec(float64(l.pixF[i]), float64(l.pixF[i+1]), float64(l.pixF[i+2]))
+}
+
+func byteAt(l *texLevel, x, y int) [4]uint8 {
+	i := 4 * (y*l.w + x)
+	return [4]uint8{l.pix8[i], l.pix8[i+1], l.pix8[i+2], l.pix8[i+3]}
+}
+
+func TestReadPFM(t *testing.T) {
+	// 2x2 little endian, the bottom row comes first.
+	var buf bytes.Buffer
+	buf.WriteString("PF\n2 2\n-1.0\n")
+	for _, f := range []float32{1, 2, 3, 4, 5, 6, 0.5, 0.25, 0.125, 10, 20, 30} {
+		binary.Write(&buf, binary.LittleEndian, f)
+	}
+	l := readTexture(writeFile(t, "test.pfm", buf.Bytes()), false)
+
+	if l.w != 2 || l.h != 2 {
+		t.Fatalf("size is %dx%d", l.w, l.h)
+	}
+	want := map[[2]int]vec3{
+		{0, 1}: vec(1.0, 2.0, 3.0), {1, 1}: vec(4.0, 5.0, 6.0),
+		{0, 0}: vec(0.5, 0.25, 0.125), {1, 0}: vec(10.0, 20.0, 30.0),
+	}
+	for p, c := range want {
+		if got := floatAt(l, p[0], p[1]); got != c {
+			t.Errorf("pixel %v is %v, want %v", p, got, c)
+		}
+	}
+
+	// Gray ones go to all three colors, and big endian.
+	buf.Reset()
+	buf.WriteString("Pf\n1 1\n1.0\n")
+	binary.Write(&buf, binary.BigEndian, float32(0.75))
+	if got := floatAt(readTexture(writeFile(t, "gray.pfm", buf.Bytes()), false), 0, 0); got != vec(0.75, 0.75, 0.75) {
+		t.Errorf("gray pixel is %v", got)
+	}
+}
+
+func TestReadTGA(t *testing.T) {
+	// 3x2 run length encoded true color, the first row is the top one.
+	hdr := make([]byte, 18)
+	hdr[2] = 10
+	binary.LittleEndian.PutUint16(hdr[12:], 3)
+	binary.LittleEndian.PutUint16(hdr[14:], 2)
+	hdr[16] = 24
+	hdr[17] = 0x20
+
+	data := append(hdr,
+		0x82, 10, 20, 30, // Three times the same pixel.
+		0x02, 1, 2, 3, 4, 5, 6, 7, 8, 9, // Three different ones.
+	)
+	l := readTexture(writeFile(t, "test.tga", data), false)
+
+	if l.w != 3 || l.h != 2 {
+		t.Fatalf("size is %dx%d", l.w, l.h)
+	}
+	want := map[[2]int][4]uint8{
+		{0, 0}: {30, 20, 10, 255}, {2, 0}: {30, 20, 10, 255},
+		{0, 1}: {3, 2, 1, 255}, {1, 1}: {6, 5, 4, 255}, {2, 1}: {9, 8, 7, 255},
+	}
+	for p, c := range want {
+		if got := byteAt(l, p[0], p[1]); got != c {
+			t.Errorf("pixel %v is %v, want %v", p, got, c)
+		}
+	}
+
+	if l := readTexture(writeFile(t, "size.tga", data), true); l.w != 3 || l.h != 2 || l.pix8 != nil {
+		t.Errorf("reading the header gave %dx%d", l.w, l.h)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+)
+
+// Without spectral mode the film is only worked out at one wavelength per color, in nm.
+var filmRGB = [3]float64{630.0, 532.0, 465.0}
+
+// Puts a thin transparent layer on the material, like oil on water or the oxide on anodized metal.
+// Light bouncing off the top and the bottom of it interferes, so the color depends on the angle.
+// The thickness is in nm, it only shows colors from about 100 to 1000. Returns the material so calls can be chained.
+func (m *material) filmCoated(thickness, index float64) *material {
+	m.film = thickness
+	m.filmIndex = index
+	return m
+}
+
+// Makes the thickness of the film vary, it's the thickness times the gray of the texture.
+func (m *material) filmMapped(tex texture) *material {
+	m.filmTex = tex
+	return m
+}
+
+// A soap bubble is a film with air on both sides, glass with an index of 1 doesn't bend the light.
+func soapBubble(thickness float64) *material {
+	return glass(1.0).filmCoated(thickness, 1.33)
+}
+
+func (m *material) filmThickness(hr *hitRecord) float64 {
+	if m.filmTex == nil {
+		return m.film
+	}
+	return m.film * gray(texValue(m.filmTex, hr))
+}
+
+// How much the film reflects for every color, f gives it for a wavelength and what the material
+// under the film reflects there. In spectral mode every wavelength does its own thing, so only the hero goes on.
+func filmColor(rIn ray, albedo vec3, f func(l, f0 float64) float64) vec3 {
+	if rIn.wl != nil {
+		rIn.wl.collapse()
+		l := rIn.wl.lambda[0]
+		r := f(l, rgbToSpectrum(albedo, l))
+		return vec(r, r, r)
+	}
+
+	return vec(f(filmRGB[0], albedo.x), f(filmRGB[1], albedo.y), f(filmRGB[2], albedo.z))
+}
+
+// Reflectance of a film between two transparent materials, light comes in from n1 with cosI and goes into n3.
+func filmOverDielectric(cosI, n1, nFilm, n3, thickness, l float64) float64 {
+	cos2, ok := cosRefracted(cosI, n1, nFilm)
+	if !ok {
+		return 1.0
+	}
+	cos3, ok := cosRefracted(cosI, n1, n3)
+	if !ok {
+		return 1.0
+	}
+
+	r12s, r12p := fresnelAmp(cosI, cos2, n1, nFilm)
+	r23s, r23p := fresnelAmp(cos2, cos3, nFilm, n3)
+
+	delta := filmPhase(nFilm, cos2, thickness, l)
+	return 0.5 * (airy(r12s, r23s, delta) + airy(r12p, r23p, delta))
+}
+
+// Reflectance of a film on metal, from air. The metal reflects f0 straight on and always flips the phase,
+// which is close enough for the colors.
+func filmOverMetal(cosI, nFilm, f0, thickness, l float64) float64 {
+	cos2, ok := cosRefracted(cosI, 1.0, nFilm)
+	if !ok {
+		return 1.0
+	}
+
+	r12s, r12p := fresnelAmp(cosI, cos2, 1.0, nFilm)
+	r23 := -math.Sqrt(f0 + (1.0-f0)*math.Pow(1.0-cos2, 5.0))
+
+	delta := filmPhase(nFilm, cos2, thickness, l)
+	return 0.5 * (airy(r12s, r23, delta) + airy(r12p, r23, delta))
+}
+
+// The cosine of the angle after going from n1 into n2, false for total internal reflection.
+func cosRefracted(cosI, n1, n2 float64) (float64, bool) {
+	sin2 := (n1 / n2) * (n1 / n2) * (1.0 - cosI*cosI)
+	if sin2 >= 1.0 {
+		return 0.0, false
+	}
+	return math.Sqrt(1.0 - sin2), true
+}
+
+// How much of the wave is reflected going from n1 into n2, for both polarizations.
+func fresnelAmp(cos1, cos2, n1, n2 float64) (float64, float64) {
+	rs := (n1*cos1 - n2*cos2) / (n1*cos1 + n2*cos2)
+	rp := (n2*cos1 - n1*cos2) / (n2*cos1 + n1*cos2)
+	return rs, rp
+}
+
+// How far behind the light from the bottom of the film is, as an angle.
+func filmPhase(nFilm, cos2, thickness, l float64) float64 {
+	return 4.0 * math.Pi * nFilm * thickness * cos2 / l
+}
+
+// Airy's formula, adds up all the bounces inside the film.
+func airy(r12, r23, delta float64) float64 {
+	c := 2.0 * r12 * r23 * math.Cos(delta)
+	return (r12*r12 + r23*r23 + c) / (1.0 + r12*r12*r23*r23 + c)
+}
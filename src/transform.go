@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Quaternions are used for rotations, unlike angles they can be interpolated without problems.
+type quat struct {
+	x, y, z, w float64
+}
+
+// A rotation of deg degrees around axis.
+func axisAngle(axis vec3, deg float64) quat {
+	sin, cos := math.Sincos(deg * math.Pi / 360.0)
+	a := axis.normalize().mulScalar(sin)
+	return quat{a.x, a.y, a.z, cos}
+}
+
+func (q quat) dot(q2 quat) float64 {
+	return q.x*q2.x + q.y*q2.y + q.z*q2.z + q.w*q2.w
+}
+
+func (q quat) normalize() quat {
+	l := math.Sqrt(q.dot(q))
+	return quat{q.x / l, q.y / l, q.z / l, q.w / l}
+}
+
+// The opposite rotation.
+func (q quat) conj() quat {
+	return quat{-q.x, -q.y, -q.z, q.w}
+}
+
+func (q quat) rotate(v vec3) vec3 {
+	u := vec(q.x, q.y, q.z)
+	t := cross(u, v).mulScalar(2.0)
+	return v.add(t.mulScalar(q.w)).add(cross(u, t))
+}
+
+// Spherical interpolation, the rotation speed stays the same the whole way.
+func slerp(q0, q1 quat, f float64) quat {
+	// Take the short way around.
+	cos := q0.dot(q1)
+	if cos < 0.0 {
+		q1 = quat{-q1.x, -q1.y, -q1.z, -q1.w}
+		cos = -cos
+	}
+
+	// Almost the same rotation, a normal lerp is good enough and doesn't divide by zero.
+	if cos > 0.9995 {
+		return quat{
+			q0.x + (q1.x-q0.x)*f,
+			q0.y + (q1.y-q0.y)*f,
+			q0.z + (q1.z-q0.z)*f,
+			q0.w + (q1.w-q0.w)*f,
+		}.normalize()
+	}
+
+	theta := math.Acos(cos)
+	w0 := math.Sin((1.0-f)*theta) / math.Sin(theta)
+	w1 := math.Sin(f*theta) / math.Sin(theta)
+	return quat{
+		q0.x*w0 + q1.x*w1,
+		q0.y*w0 + q1.y*w1,
+		q0.z*w0 + q1.z*w1,
+		q0.w*w0 + q1.w*w1,
+	}
+}
+
+// Scales, then rotates and then moves a point.
+type transform struct {
+	translate vec3
+	rotate    quat
+	scale     vec3
+}
+
+func (xf transform) toWorld(p vec3) vec3 {
+	return xf.rotate.rotate(p.mul(xf.scale)).add(xf.translate)
+}
+
+func (xf transform) dirToWorld(d vec3) vec3 {
+	return xf.rotate.rotate(d.mul(xf.scale))
+}
+
+func (xf transform) toLocal(p vec3) vec3 {
+	return xf.dirToLocal(p.sub(xf.translate))
+}
+
+func (xf transform) dirToLocal(d vec3) vec3 {
+	return xf.rotate.conj().rotate(d).div(xf.scale)
+}
+
+// Normals need the inverse scale, otherwise they won't be perpendicular to a stretched surface anymore.
+func (xf transform) normalToWorld(n vec3) vec3 {
+	return xf.rotate.rotate(n.div(xf.scale)).normalize()
+}
+
+// The transform of an object at a certain time.
+type transformKey struct {
+	time float64
+	transform
+}
+
+// Rotation is deg degrees around axis.
+func key(time float64, translate, axis vec3, deg float64, scale vec3) transformKey {
+	return transformKey{time, transform{translate, axisAngle(axis, deg), scale}}
+}
+
+// Keyframes sorted by time, before the first and after the last key the object stands still.
+type motion []transformKey
+
+func newMotion(keys []transformKey) motion {
+	m := make(motion, len(keys))
+	copy(m, keys)
+	sort.Slice(m, func(i, j int) bool { return m[i].time < m[j].time })
+	return m
+}
+
+func (m motion) at(t float64) transform {
+	if t <= m[0].time {
+		return m[0].transform
+	}
+	if t >= m[len(m)-1].time {
+		return m[len(m)-1].transform
+	}
+
+	i := sort.Search(len(m), func(i int) bool { return m[i].time > t })
+	k0, k1 := m[i-1], m[i]
+	f := (t - k0.time) / (k1.time - k0.time)
+
+	return transform{
+		k0.translate.add(k1.translate.sub(k0.translate).mulScalar(f)),
+		slerp(k0.rotate, k1.rotate, f),
+		k0.scale.add(k1.scale.sub(k0.scale).mulScalar(f)),
+	}
+}
+
+// Number of steps we take between two keys to find the bounding box.
+const motionSteps = 32
+
+// The box around everywhere the local box goes between t0 and t1. The box is sampled at small steps,
+// between those a rotating corner can bulge out of the box a little, so we add that as a margin.
+func (m motion) bounds(local *aabb, t0, t1 float64) *aabb {
+	// Every key in the interval and the two ends.
+	times := []float64{t0, t1}
+	for _, k := range m {
+		if k.time > t0 && k.time < t1 {
+			times = append(times, k.time)
+		}
+	}
+	sort.Float64s(times)
+
+	var box *aabb
+	maxAngle := 0.0
+	maxDist := 0.0
+	for i := 0; i+1 < len(times); i++ {
+		prev := m.at(times[i]).rotate
+		for s := 0; s <= motionSteps; s++ {
+			xf := m.at(times[i] + (times[i+1]-times[i])*float64(s)/motionSteps)
+
+			// The angle between this step and the last one.
+			cos := math.Min(1.0, math.Abs(prev.dot(xf.rotate)))
+			maxAngle = math.Max(maxAngle, 2.0*math.Acos(cos))
+			prev = xf.rotate
+
+			for c := 0; c < 8; c++ {
+				corner := vec(local.min.x, local.min.y, local.min.z)
+				if c&1 != 0 {
+					corner.x = local.max.x
+				}
+				if c&2 != 0 {
+					corner.y = local.max.y
+				}
+				if c&4 != 0 {
+					corner.z = local.max.z
+				}
+
+				p := xf.toWorld(corner)
+				maxDist = math.Max(maxDist, p.sub(xf.translate).length())
+				if box == nil {
+					box = &aabb{p, p}
+				} else {
+					box = surroundingBox(box, &aabb{p, p})
+				}
+			}
+		}
+	}
+
+	margin := maxDist*(1.0-math.Cos(maxAngle/2.0)) + 1e-6
+	return &aabb{box.min.subScalar(margin), box.max.addScalar(margin)}
+}